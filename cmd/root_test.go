@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestStringArray(t *testing.T) {
+	newCmd := func() *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().StringArray("m3u-url", nil, "")
+		return cmd
+	}
+
+	t.Setenv("M3U_URL", "http://example.com/iptv.m3u|prefix=EX: ;\n  /root/iptv/fta.m3u|group=Free to air\n\n")
+	want := []string{"http://example.com/iptv.m3u|prefix=EX: ", "/root/iptv/fta.m3u|group=Free to air"}
+	if got := stringArray(newCmd(), "m3u-url"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the sources of the environment %q, got %q", want, got)
+	}
+
+	cmd := newCmd()
+	if err := cmd.Flags().Parse([]string{"--m3u-url", "http://example.com/one.m3u;two", "--m3u-url", "three"}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"http://example.com/one.m3u;two", "three"}
+	if got := stringArray(cmd, "m3u-url"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the flags to win over the environment %q, got %q", want, got)
+	}
+}
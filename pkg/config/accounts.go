@@ -0,0 +1,127 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Account is an iptv-proxy user
+type Account struct {
+	Username CredentialString
+	Password CredentialString
+	// AllowedGroups are the group titles (or xtream category names) the user can access, all if empty
+	AllowedGroups []string
+	// MaxConnections is the maximum number of concurrent streams of the user, unlimited if zero
+	MaxConnections int
+	// ExpDate is the expiration date of the account, never if zero
+	ExpDate time.Time
+}
+
+// Expired reports whether the account is expired.
+func (a *Account) Expired() bool {
+	return !a.ExpDate.IsZero() && time.Now().After(a.ExpDate)
+}
+
+// AllowGroup reports whether the account can access the group.
+func (a *Account) AllowGroup(group string) bool {
+	if len(a.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, g := range a.AllowedGroups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type accountFile struct {
+	Users []struct {
+		Username       string   `mapstructure:"username"`
+		Password       string   `mapstructure:"password"`
+		AllowedGroups  []string `mapstructure:"allowed-groups"`
+		MaxConnections int      `mapstructure:"max-connections"`
+		ExpDate        string   `mapstructure:"exp-date"`
+	} `mapstructure:"users"`
+}
+
+// LoadAccounts reads the users file (yaml, json or toml) at path.
+func LoadAccounts(path string) ([]Account, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("unable to read users file: %v", err)
+	}
+
+	var f accountFile
+	if err := v.Unmarshal(&f); err != nil {
+		return nil, fmt.Errorf("unable to parse users file: %v", err)
+	}
+	if len(f.Users) == 0 {
+		return nil, fmt.Errorf("users file: no user defined")
+	}
+
+	accounts := make([]Account, 0, len(f.Users))
+	seen := make(map[string]bool, len(f.Users))
+	for _, u := range f.Users {
+		if u.Username == "" || u.Password == "" {
+			return nil, fmt.Errorf("users file: username and password are required")
+		}
+		if seen[u.Username] {
+			return nil, fmt.Errorf("users file: duplicate user %q", u.Username)
+		}
+		seen[u.Username] = true
+
+		a := Account{
+			Username:       CredentialString(u.Username),
+			Password:       CredentialString(u.Password),
+			AllowedGroups:  u.AllowedGroups,
+			MaxConnections: u.MaxConnections,
+		}
+
+		if u.ExpDate != "" {
+			expDate, err := parseDate(u.ExpDate)
+			if err != nil {
+				return nil, fmt.Errorf("users file: user %q: invalid exp-date %q", u.Username, u.ExpDate)
+			}
+			a.ExpDate = expDate
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	return accounts, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown date format")
+}
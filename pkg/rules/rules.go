@@ -0,0 +1,267 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rules filters and rewrites playlist tracks from a declarative rules file.
+//
+// A rules file (yaml, json or toml) contains an ordered list of rules:
+//
+//	rules:
+//	  - group: "(?i)adult"
+//	    action: exclude
+//	  - name: "^FR: (.*)"
+//	    rename: "$1"
+//	    set:
+//	      group-title: "France"
+//	      tvg-chno: "12"
+//
+// Each rule matches a track when all of its non empty patterns (group, name,
+// tvg-id, url) match. Rules are evaluated in order and a later rule sees the
+// changes made by the previous ones. If the file contains at least one
+// include rule, only the tracks matched by an include rule are kept.
+//
+// A rule can also shift the programme times of the guide of the matched
+// channels, for the providers sending a wrong timezone:
+//
+//	rules:
+//	  - group: "^UK"
+//	    epg-offset: "-1h"
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/spf13/viper"
+)
+
+const (
+	actionInclude = "include"
+	actionExclude = "exclude"
+	actionRewrite = "rewrite"
+)
+
+// Rule matches tracks and tells what to do with them.
+type Rule struct {
+	Group  string            `mapstructure:"group"`
+	Name   string            `mapstructure:"name"`
+	TvgID  string            `mapstructure:"tvg-id"`
+	URL    string            `mapstructure:"url"`
+	Action string            `mapstructure:"action"`
+	Rename string            `mapstructure:"rename"`
+	Set    map[string]string `mapstructure:"set"`
+	// EPGOffset shifts the guide of the matched channels
+	EPGOffset time.Duration `mapstructure:"epg-offset"`
+
+	group, name, tvgID, url *regexp.Regexp
+}
+
+// Ruleset is an ordered list of rules.
+type Ruleset struct {
+	Rules []Rule `mapstructure:"rules"`
+
+	hasInclude    bool
+	hasEPGOffsets bool
+}
+
+// Load reads the rules file at path.
+func Load(path string) (*Ruleset, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("unable to read rules file: %v", err)
+	}
+
+	rs := &Ruleset{}
+	if err := v.Unmarshal(rs); err != nil {
+		return nil, fmt.Errorf("unable to parse rules file: %v", err)
+	}
+
+	if err := rs.compile(); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (rs *Ruleset) compile() error {
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+
+		r.Action = strings.ToLower(r.Action)
+		switch r.Action {
+		case "":
+			r.Action = actionRewrite
+		case actionInclude:
+			rs.hasInclude = true
+		case actionExclude, actionRewrite:
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i, r.Action)
+		}
+
+		if r.EPGOffset != 0 {
+			rs.hasEPGOffsets = true
+		}
+
+		for _, p := range []struct {
+			pattern string
+			re      **regexp.Regexp
+		}{
+			{r.Group, &r.group},
+			{r.Name, &r.name},
+			{r.TvgID, &r.tvgID},
+			{r.URL, &r.url},
+		} {
+			if p.pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile(p.pattern)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+			*p.re = re
+		}
+	}
+
+	return nil
+}
+
+// Apply returns the tracks kept by the rules, rewritten.
+// The given tracks are left untouched.
+func (rs *Ruleset) Apply(tracks []m3u.Track) []m3u.Track {
+	if rs == nil || len(rs.Rules) == 0 {
+		return tracks
+	}
+
+	kept := make([]m3u.Track, 0, len(tracks))
+	for _, track := range tracks {
+		if track, keep, _ := rs.apply(track); keep {
+			kept = append(kept, track)
+		}
+	}
+
+	return kept
+}
+
+// HasEPGOffsets reports whether a rule shifts the guide.
+func (rs *Ruleset) HasEPGOffsets() bool {
+	return rs != nil && rs.hasEPGOffsets
+}
+
+// EPGOffsets returns the guide offset of the tracks kept by the rules, by their rewritten tvg-id.
+// The offset of a track is the one of the last rule matching it with an epg-offset.
+func (rs *Ruleset) EPGOffsets(tracks []m3u.Track) map[string]time.Duration {
+	offsets := make(map[string]time.Duration)
+	if !rs.HasEPGOffsets() {
+		return offsets
+	}
+
+	for _, track := range tracks {
+		track, keep, offset := rs.apply(track)
+		if id := Tag(track, "tvg-id"); keep && id != "" && offset != 0 {
+			offsets[id] = offset
+		}
+	}
+
+	return offsets
+}
+
+// apply runs the rules on a copy of track, it returns the rewritten track,
+// whether it is kept and its guide offset.
+func (rs *Ruleset) apply(track m3u.Track) (m3u.Track, bool, time.Duration) {
+	track.Tags = append([]m3u.Tag(nil), track.Tags...)
+
+	keep := !rs.hasInclude
+	var offset time.Duration
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if !r.match(&track) {
+			continue
+		}
+
+		switch r.Action {
+		case actionInclude:
+			keep = true
+		case actionExclude:
+			keep = false
+		}
+		if r.EPGOffset != 0 {
+			offset = r.EPGOffset
+		}
+		r.rewrite(&track)
+	}
+
+	return track, keep, offset
+}
+
+func (r *Rule) match(track *m3u.Track) bool {
+	return matchPattern(r.group, Tag(*track, "group-title")) &&
+		matchPattern(r.name, track.Name) &&
+		matchPattern(r.tvgID, Tag(*track, "tvg-id")) &&
+		matchPattern(r.url, track.URI)
+}
+
+func matchPattern(re *regexp.Regexp, s string) bool {
+	return re == nil || re.MatchString(s)
+}
+
+func (r *Rule) rewrite(track *m3u.Track) {
+	if r.Rename != "" {
+		if r.name != nil {
+			track.Name = r.name.ReplaceAllString(track.Name, r.Rename)
+		} else {
+			track.Name = r.Rename
+		}
+	}
+
+	names := make([]string, 0, len(r.Set))
+	for name := range r.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		SetTag(track, name, r.Set[name])
+	}
+}
+
+// Tag returns the value of the tag name of the track, the tag name is case insensitive.
+func Tag(track m3u.Track, name string) string {
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// SetTag set the value of the tag name of the track, adding it if needed.
+func SetTag(track *m3u.Track, name, value string) {
+	for i := range track.Tags {
+		if strings.EqualFold(track.Tags[i].Name, name) {
+			track.Tags[i].Value = value
+			return
+		}
+	}
+
+	track.Tags = append(track.Tags, m3u.Tag{Name: name, Value: value})
+}
@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+func loadRules(t *testing.T, name, content string) *Ruleset {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	return rs
+}
+
+func testTracks() []m3u.Track {
+	return []m3u.Track{
+		{Name: "FR: TF1", URI: "http://example.com/1.ts", Tags: []m3u.Tag{{Name: "tvg-id", Value: "tf1.fr"}, {Name: "group-title", Value: "FR"}}},
+		{Name: "Adult 1", URI: "http://example.com/2.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "XXX Adult"}}},
+		{Name: "BBC One", URI: "http://example.com/3.ts", Tags: []m3u.Tag{{Name: "tvg-id", Value: "bbc1.uk"}, {Name: "group-title", Value: "UK"}}},
+	}
+}
+
+func TestApply(t *testing.T) {
+	rs := loadRules(t, "rules.yaml", `
+rules:
+  - group: "(?i)adult"
+    action: exclude
+  - name: "^FR: (.*)"
+    rename: "$1"
+    set:
+      group-title: "France"
+      tvg-chno: "1"
+`)
+
+	tracks := testTracks()
+	got := rs.Apply(tracks)
+
+	if len(got) != 2 {
+		t.Fatalf("Apply() kept %d tracks, want 2", len(got))
+	}
+	if got[0].Name != "TF1" {
+		t.Errorf("Apply() name = %q, want %q", got[0].Name, "TF1")
+	}
+	if v := Tag(got[0], "group-title"); v != "France" {
+		t.Errorf("Apply() group-title = %q, want %q", v, "France")
+	}
+	if v := Tag(got[0], "tvg-chno"); v != "1" {
+		t.Errorf("Apply() tvg-chno = %q, want %q", v, "1")
+	}
+	if v := Tag(tracks[0], "group-title"); v != "FR" {
+		t.Errorf("Apply() modified the original track, group-title = %q", v)
+	}
+}
+
+func TestApplyInclude(t *testing.T) {
+	rs := loadRules(t, "rules.json", `{
+  "rules": [
+    {"tvg-id": "\\.uk$", "action": "include"},
+    {"url": "/1\\.ts$", "action": "include"}
+  ]
+}`)
+
+	got := rs.Apply(testTracks())
+	if len(got) != 2 || got[0].Name != "FR: TF1" || got[1].Name != "BBC One" {
+		t.Errorf("Apply() = %+v, want TF1 and BBC One", got)
+	}
+}
+
+func TestLoadInvalidAction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte("rules:\n  - name: foo\n    action: drop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Error("Load() expected an error for an unknown action")
+	}
+}
+
+func TestApplyNilRuleset(t *testing.T) {
+	var rs *Ruleset
+	if got := rs.Apply(testTracks()); len(got) != 3 {
+		t.Errorf("Apply() on nil ruleset kept %d tracks, want 3", len(got))
+	}
+}
+
+func TestEPGOffsets(t *testing.T) {
+	rs := loadRules(t, "rules.yaml", `
+rules:
+  - group: "^UK$"
+    epg-offset: "-1h"
+  - name: "^BBC One$"
+    set:
+      group-title: "BBC"
+  - group: "^BBC$"
+    epg-offset: "30m"
+  - group: "(?i)adult"
+    action: exclude
+    epg-offset: "2h"
+`)
+
+	if !rs.HasEPGOffsets() {
+		t.Fatal("HasEPGOffsets() = false, want true")
+	}
+
+	tracks := testTracks()
+	tracks = append(tracks, m3u.Track{Name: "UK News", Tags: []m3u.Tag{{Name: "tvg-id", Value: "news.uk"}, {Name: "group-title", Value: "UK"}}})
+
+	got := rs.EPGOffsets(tracks)
+	want := map[string]time.Duration{"bbc1.uk": 30 * time.Minute, "news.uk": -time.Hour}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EPGOffsets() = %v, want %v", got, want)
+	}
+
+	var nilRules *Ruleset
+	if nilRules.HasEPGOffsets() || len(nilRules.EPGOffsets(tracks)) != 0 {
+		t.Error("Expected no offset without rules")
+	}
+}
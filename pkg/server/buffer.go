@@ -20,8 +20,10 @@ package server
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
@@ -31,23 +33,34 @@ const (
 	DefaultBufferDuration = 5 * time.Second
 	// DefaultChunkSize is the size of each buffer chunk in bytes
 	DefaultChunkSize = 32 * 1024 // 32KB chunks
-	// MaxBufferMemory is the maximum memory per stream buffer
-	MaxBufferMemory = 10 * 1024 * 1024 // 10MB per stream
+	// DefaultMaxBufferMemory is the default memory cap of a stream buffer
+	DefaultMaxBufferMemory = 10 * 1024 * 1024 // 10MB per stream
+	// estimatedBytesPerSecond sizes a buffer until its bitrate is measured
+	estimatedBytesPerSecond = 250 * 1024 // 2Mbps / 8 = 250KB/s
+	// minBufferChunks is the minimum capacity of a buffer
+	minBufferChunks = 10
+	// bitrateWindow is the interval the ingest bitrate is measured over
+	bitrateWindow = 2 * time.Second
+	// retentionMargin is kept on top of the buffer duration to start the readers on a keyframe
+	retentionMargin = 3 * time.Second
 )
 
-// BufferChunk represents a single chunk of buffered data
+// BufferChunk represents a single chunk of buffered data.
+// The chunks of an MPEG-TS stream hold whole packets, a keyframe chunk starts with a random access point.
 type BufferChunk struct {
 	Data      []byte
 	Timestamp time.Time
 	Size      int
+	Keyframe  bool
 }
 
 // StreamBuffer implements a ring buffer for stream data
 type StreamBuffer struct {
 	chunks        []*BufferChunk
-	writeIndex    int
-	readIndex     int
-	size          int
+	// sequence numbers of the oldest chunk and of the next chunk written,
+	// the chunk of sequence seq is chunks[seq%capacity]
+	firstSeq      int64
+	nextSeq       int64
 	capacity      int
 	bufferTime    time.Duration
 	chunkSize     int
@@ -56,48 +69,97 @@ type StreamBuffer struct {
 	readers       map[string]*BufferReader
 	readersMutex  sync.RWMutex
 	lastWrite     time.Time
+	upstream      string
+	bytesIn       int64 // accessed atomically
+	bytesOut      int64 // accessed atomically
 	closed        bool
+	// err is why the source failed before sending anything
+	err           error
 	ctx           context.Context
 	cancel        context.CancelFunc
+	// closed and replaced on each write, to wake up the waiting readers
+	signal        chan struct{}
+	// time of the first write
+	started       time.Time
+
+	// MPEG-TS alignment, ts is nil until the stream is detected as MPEG-TS
+	detected      bool
+	probeStart    time.Time
+	ts            *tsIndexer
+	pending       []byte
+	droppedBytes  int64
+	// sequence numbers of the keyframe chunks, oldest first
+	keyframes     []int64
+	// the upstream reconnected, the packets are dropped until a keyframe of the new connection
+	resuming      bool
+	resumeSince   time.Time
+	reconnects    int64
+
+	// memory cap in bytes, the ring is resized from the measured ingest rates
+	// to hold bufferTime of the stream within it
+	maxMemory     int64
+	bitrate       float64 // bytes per second
+	chunkRate     float64 // chunks per second
+	measured      bool
+	windowStart   time.Time
+	windowBytes   int64
+	windowChunks  int64
+	// time the last reader left, protected by readersMutex
+	idleSince     time.Time
+
+	// timeshift recording of the stream, nil if disabled
+	recorder      *timeshiftRecorder
 }
 
 // BufferReader represents a client reading from the buffer
 type BufferReader struct {
 	id         string
-	readIndex  int
+	// sequence number of the chunk read and offset in it
+	seq        int64
+	offset     int
+	// the reader waits for a keyframe chunk to start
+	waitKeyframe bool
+	// PAT and PMT sent before the first chunk
+	prelude    []byte
+	// a passive reader keeps the buffer open without reading it
+	passive    bool
+	created    time.Time
 	lastRead   time.Time
 	buffer     *StreamBuffer
 }
 
+// maxKeyframeWait is how long a new reader waits for a keyframe before starting anyway
+const maxKeyframeWait = 5 * time.Second
+
+// maxReadWait is how long a reader with nothing to read waits for the buffer before checking again
+const maxReadWait = 100 * time.Millisecond
+
+// errPreloadTimeout is returned when the source sends nothing within the preload timeout
+var errPreloadTimeout = errors.New("no data received from the source")
+
 // NewStreamBuffer creates a new stream buffer
 func NewStreamBuffer(bufferDuration time.Duration) *StreamBuffer {
 	if bufferDuration <= 0 {
 		bufferDuration = DefaultBufferDuration
 	}
 
-	// Calculate capacity based on buffer duration and estimated bitrate
-	// Assume average bitrate of 2Mbps for capacity calculation
-	estimatedBytesPerSecond := 250 * 1024 // 2Mbps / 8 = 250KB/s
-	estimatedTotalBytes := int(bufferDuration.Seconds()) * estimatedBytesPerSecond
-	capacity := estimatedTotalBytes / DefaultChunkSize
-	if capacity < 10 {
-		capacity = 10 // Minimum capacity
-	}
-	if capacity > MaxBufferMemory/DefaultChunkSize {
-		capacity = MaxBufferMemory / DefaultChunkSize // Maximum capacity
-	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// The buffer is sized for an estimated bitrate until the actual one is measured
 	buffer := &StreamBuffer{
-		chunks:     make([]*BufferChunk, capacity),
-		capacity:   capacity,
 		bufferTime: bufferDuration,
 		chunkSize:  DefaultChunkSize,
 		readers:    make(map[string]*BufferReader),
+		maxMemory:  DefaultMaxBufferMemory,
+		bitrate:    estimatedBytesPerSecond,
+		chunkRate:  float64(estimatedBytesPerSecond) / DefaultChunkSize,
+		idleSince:  time.Now(),
 		ctx:        ctx,
 		cancel:     cancel,
+		signal:     make(chan struct{}),
 	}
+	buffer.capacity = buffer.targetCapacity()
+	buffer.chunks = make([]*BufferChunk, buffer.capacity)
 
 	// Start cleanup goroutine
 	go buffer.cleanup()
@@ -105,7 +167,8 @@ func NewStreamBuffer(bufferDuration time.Duration) *StreamBuffer {
 	return buffer
 }
 
-// Write writes data to the buffer
+// Write writes data to the buffer.
+// An MPEG-TS stream is split on the packets, a new chunk starting on each random access point.
 func (sb *StreamBuffer) Write(data []byte) (int, error) {
 	sb.mutex.Lock()
 	defer sb.mutex.Unlock()
@@ -114,9 +177,161 @@ func (sb *StreamBuffer) Write(data []byte) (int, error) {
 		return 0, io.ErrClosedPipe
 	}
 
-	totalWritten := 0
-	now := time.Now()
+	sb.write(data, time.Now())
+	sb.broadcast()
+	return len(data), nil
+}
+
+// broadcast wakes up the readers waiting for the buffer, the caller holds the buffer lock.
+func (sb *StreamBuffer) broadcast() {
+	close(sb.signal)
+	sb.signal = make(chan struct{})
+}
+
+// write buffers data received at now, the caller holds the buffer lock.
+func (sb *StreamBuffer) write(data []byte, now time.Time) {
+	if sb.started.IsZero() {
+		sb.started = now
+	}
+	sb.lastWrite = now
+	seq := sb.nextSeq
+	defer func() { sb.measure(now, len(data), sb.nextSeq-seq) }()
+
+	if !sb.detected {
+		// The stream is probed on three packets, a sync byte alone can be a chance
+		if len(sb.pending) == 0 {
+			sb.probeStart = now
+			time.AfterFunc(tsProbeTimeout, sb.endProbe)
+		}
+		sb.pending = append(sb.pending, data...)
+		if len(sb.pending) >= tsProbeSize || now.Sub(sb.probeStart) >= tsProbeTimeout {
+			sb.detect(now)
+		}
+		return
+	}
+
+	if sb.ts == nil {
+		sb.writeRaw(data, now)
+		return
+	}
+
+	sb.pending = append(sb.pending, data...)
+	sb.writePackets(now)
+}
+
+// detect buffers the probe as MPEG-TS packets or as raw chunks, the caller holds the buffer lock.
+func (sb *StreamBuffer) detect(now time.Time) {
+	sb.detected = true
+	if tsDetect(sb.pending) {
+		sb.ts = newTSIndexer()
+		sb.writePackets(now)
+		return
+	}
 
+	log.Printf("[buffer] Stream is not MPEG-TS, buffering raw chunks")
+	data := sb.pending
+	sb.pending = nil
+	sb.writeRaw(data, now)
+}
+
+// endProbe decides on a probe shorter than tsProbeSize, when the source sent nothing more within tsProbeTimeout.
+func (sb *StreamBuffer) endProbe() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if sb.closed || sb.detected || len(sb.pending) == 0 || time.Since(sb.probeStart) < tsProbeTimeout {
+		return
+	}
+	sb.detect(sb.lastWrite)
+	sb.broadcast()
+}
+
+// measure updates the ingest bitrate and chunk rate with a write of n bytes in chunks,
+// and resizes the ring when it no longer fits them.
+func (sb *StreamBuffer) measure(now time.Time, n int, chunks int64) {
+	if sb.windowStart.IsZero() {
+		// The rates are measured on what is received after the first write
+		sb.windowStart = now
+		return
+	}
+	sb.windowBytes += int64(n)
+	sb.windowChunks += chunks
+
+	elapsed := now.Sub(sb.windowStart)
+	if elapsed < bitrateWindow {
+		return
+	}
+
+	bitrate := float64(sb.windowBytes) / elapsed.Seconds()
+	chunkRate := float64(sb.windowChunks) / elapsed.Seconds()
+	if sb.measured {
+		// Smooth out the bursts of the upstream
+		bitrate = 0.7*sb.bitrate + 0.3*bitrate
+		chunkRate = 0.7*sb.chunkRate + 0.3*chunkRate
+	}
+	sb.bitrate, sb.chunkRate, sb.measured = bitrate, chunkRate, true
+	sb.windowStart, sb.windowBytes, sb.windowChunks = now, 0, 0
+
+	// Resize on significant changes only, the chunks are copied
+	capacity := sb.targetCapacity()
+	if diff := capacity - sb.capacity; diff*5 > sb.capacity || -diff*5 > sb.capacity {
+		sb.resize(capacity)
+	}
+}
+
+// targetCapacity returns the number of chunks holding the buffer duration and its margin
+// at the measured rates, fewer if they don't fit in the memory cap.
+func (sb *StreamBuffer) targetCapacity() int {
+	seconds := (sb.bufferTime + retentionMargin).Seconds()
+
+	chunks := sb.chunkRate * seconds
+	if bytes := sb.bitrate * seconds; bytes > float64(sb.maxMemory) {
+		chunks = chunks * float64(sb.maxMemory) / bytes
+	}
+
+	capacity := int(math.Ceil(chunks))
+	if capacity < minBufferChunks {
+		capacity = minBufferChunks
+	}
+	return capacity
+}
+
+// resize moves the chunks to a ring of capacity chunks, dropping the oldest ones if they don't fit.
+func (sb *StreamBuffer) resize(capacity int) {
+	for sb.nextSeq-sb.firstSeq > int64(capacity) {
+		sb.evict()
+	}
+
+	chunks := make([]*BufferChunk, capacity)
+	for seq := sb.firstSeq; seq < sb.nextSeq; seq++ {
+		chunks[seq%int64(capacity)] = sb.chunk(seq)
+	}
+
+	log.Printf("[buffer] Resized from %d to %d chunks, ingest at %.0f kbps", sb.capacity, capacity, sb.bitrate*8/1000)
+	sb.chunks = chunks
+	sb.capacity = capacity
+}
+
+// setMaxMemory sets the memory cap of the buffer in bytes, DefaultMaxBufferMemory if not positive
+func (sb *StreamBuffer) setMaxMemory(maxMemory int64) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if maxMemory <= 0 {
+		maxMemory = DefaultMaxBufferMemory
+	}
+	sb.maxMemory = maxMemory
+
+	for sb.totalBytes > sb.maxMemory {
+		sb.evict()
+	}
+	if capacity := sb.targetCapacity(); capacity != sb.capacity {
+		sb.resize(capacity)
+	}
+}
+
+// writeRaw splits data into chunks of chunkSize.
+func (sb *StreamBuffer) writeRaw(data []byte, now time.Time) {
 	for len(data) > 0 {
 		chunkData := data
 		if len(chunkData) > sb.chunkSize {
@@ -129,32 +344,135 @@ func (sb *StreamBuffer) Write(data []byte) (int, error) {
 			Size:      len(chunkData),
 		}
 		copy(chunk.Data, chunkData)
+		sb.commit(chunk)
 
-		// Replace old chunk if buffer is full
-		if sb.chunks[sb.writeIndex] != nil {
-			sb.totalBytes -= int64(sb.chunks[sb.writeIndex].Size)
-		}
+		data = data[len(chunkData):]
+	}
+}
 
-		sb.chunks[sb.writeIndex] = chunk
-		sb.totalBytes += int64(chunk.Size)
+// writePackets moves the whole packets of the pending data into chunks,
+// the bytes out of sync are dropped.
+func (sb *StreamBuffer) writePackets(now time.Time) {
+	maxChunk := sb.chunkSize / tsPacketSize * tsPacketSize
+
+	var chunk *BufferChunk
+	var prefix []byte
+	pending := sb.pending
+	for len(pending) >= tsPacketSize {
+		if pending[0] != tsSyncByte {
+			offset := tsSync(pending)
+			if offset < 0 {
+				// None of the first packet size bytes starts a packet
+				offset = tsPacketSize
+			}
+			sb.droppedBytes += int64(offset)
+			pending = pending[offset:]
+			continue
+		}
 
-		sb.writeIndex = (sb.writeIndex + 1) % sb.capacity
-		if sb.size < sb.capacity {
-			sb.size++
-		} else {
-			// Buffer is full, move read index
-			sb.readIndex = (sb.readIndex + 1) % sb.capacity
+		packet := tsPacket(pending[:tsPacketSize])
+		keyframe := sb.ts.inspect(packet)
+		if sb.resuming {
+			if !keyframe && now.Sub(sb.resumeSince) < maxKeyframeWait {
+				sb.droppedBytes += tsPacketSize
+				pending = pending[tsPacketSize:]
+				continue
+			}
+			// The new connection starts with the discontinuity and its tables
+			sb.resuming = false
+			prefix = sb.ts.discontinuity()
+		}
+		if chunk != nil && (keyframe || prefix != nil || len(chunk.Data)+tsPacketSize > maxChunk) {
+			sb.commit(chunk)
+			chunk = nil
 		}
+		if chunk == nil {
+			// The chunk holds at most the pending packets, the memory cap counts the bytes buffered
+			size := len(pending) / tsPacketSize * tsPacketSize
+			if size > maxChunk {
+				size = maxChunk
+			}
+			chunk = &BufferChunk{
+				Data:      make([]byte, 0, len(prefix)+size),
+				Timestamp: now,
+				Keyframe:  keyframe,
+			}
+			chunk.Data = append(chunk.Data, prefix...)
+			prefix = nil
+		}
+		chunk.Data = append(chunk.Data, packet...)
+		chunk.Size = len(chunk.Data)
 
-		totalWritten += len(chunkData)
-		data = data[len(chunkData):]
+		pending = pending[tsPacketSize:]
+	}
+	if chunk != nil {
+		sb.commit(chunk)
 	}
 
-	sb.lastWrite = now
-	return totalWritten, nil
+	sb.pending = append(sb.pending[:0], pending...)
+}
+
+// discontinuity marks a reconnection to the upstream: an MPEG-TS stream resumes on the next
+// keyframe of the new connection, after discontinuity packets and the tables so the players
+// recover without being restarted.
+func (sb *StreamBuffer) discontinuity() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	sb.reconnects++
+	if sb.ts == nil {
+		// The probe of a connection ended too early is dropped
+		sb.droppedBytes += int64(len(sb.pending))
+		sb.pending = sb.pending[:0]
+		return
+	}
+
+	// The partial packet of the previous connection is dropped
+	sb.droppedBytes += int64(len(sb.pending))
+	sb.pending = sb.pending[:0]
+	sb.resuming = true
+	sb.resumeSince = time.Now()
+}
+
+// commit appends the chunk to the ring, replacing the oldest ones if the buffer is full
+// or over its memory cap.
+func (sb *StreamBuffer) commit(chunk *BufferChunk) {
+	for sb.nextSeq > sb.firstSeq &&
+		(sb.nextSeq-sb.firstSeq >= int64(sb.capacity) || sb.totalBytes+int64(chunk.Size) > sb.maxMemory) {
+		sb.evict()
+	}
+
+	sb.chunks[sb.nextSeq%int64(sb.capacity)] = chunk
+	sb.totalBytes += int64(chunk.Size)
+	if chunk.Keyframe {
+		sb.keyframes = append(sb.keyframes, sb.nextSeq)
+	}
+	sb.nextSeq++
+
+	if sb.recorder != nil {
+		sb.recorder.record(chunk, sb.ts)
+	}
+}
+
+// evict drops the oldest chunk of the ring.
+func (sb *StreamBuffer) evict() {
+	index := sb.firstSeq % int64(sb.capacity)
+	sb.totalBytes -= int64(sb.chunks[index].Size)
+	sb.chunks[index] = nil
+	sb.firstSeq++
+	for len(sb.keyframes) > 0 && sb.keyframes[0] < sb.firstSeq {
+		sb.keyframes = sb.keyframes[1:]
+	}
 }
 
-// NewReader creates a new reader for this buffer
+// chunk returns the chunk of sequence number seq, the caller checks it is in the ring.
+func (sb *StreamBuffer) chunk(seq int64) *BufferChunk {
+	return sb.chunks[seq%int64(sb.capacity)]
+}
+
+// NewReader creates a new reader for this buffer.
+// The reader of an MPEG-TS stream starts with the PAT and PMT followed by the keyframe
+// the nearest to the buffer delay.
 func (sb *StreamBuffer) NewReader(id string) *BufferReader {
 	sb.readersMutex.Lock()
 	defer sb.readersMutex.Unlock()
@@ -162,52 +480,71 @@ func (sb *StreamBuffer) NewReader(id string) *BufferReader {
 	sb.mutex.RLock()
 	defer sb.mutex.RUnlock()
 
+	now := time.Now()
 	reader := &BufferReader{
 		id:       id,
 		buffer:   sb,
-		lastRead: time.Now(),
+		created:  now,
+		lastRead: now,
 	}
 
 	// Start reading from a position that's bufferTime behind current write
-	now := time.Now()
-	targetTime := now.Add(-sb.bufferTime)
-
-	// Find the appropriate starting position
-	reader.readIndex = sb.findReadPosition(targetTime)
+	reader.seq, reader.waitKeyframe = sb.findReadPosition(now.Add(-sb.bufferTime))
+	if !reader.waitKeyframe {
+		reader.prelude = sb.prelude()
+	}
 
 	sb.readers[id] = reader
-	log.Printf("[buffer] New reader %s created, starting at index %d", id, reader.readIndex)
+	sb.idleSince = time.Time{}
+	log.Printf("[buffer] New reader %s created, starting at chunk %d (keyframe: %t)", id, reader.seq, sb.ts != nil && !reader.waitKeyframe)
 
 	return reader
 }
 
-// findReadPosition finds the best read position for a given target time
-func (sb *StreamBuffer) findReadPosition(targetTime time.Time) int {
-	if sb.size == 0 {
-		return sb.readIndex
-	}
-
-	// Find the chunk closest to but not newer than target time
-	bestIndex := sb.readIndex
-	bestDiff := time.Duration(1 << 62) // Max duration
-
-	for i := 0; i < sb.size; i++ {
-		index := (sb.readIndex + i) % sb.capacity
-		chunk := sb.chunks[index]
-		if chunk == nil {
-			continue
+// findReadPosition returns the chunk to start reading from for a given target time:
+// the keyframe the nearest to it for an MPEG-TS stream, otherwise the chunk closest
+// to but not newer than it. A reader with no keyframe to start from waits for the next one.
+func (sb *StreamBuffer) findReadPosition(targetTime time.Time) (int64, bool) {
+	if sb.ts != nil || !sb.detected {
+		if len(sb.keyframes) == 0 {
+			return sb.nextSeq, true
 		}
 
-		if chunk.Timestamp.Before(targetTime) || chunk.Timestamp.Equal(targetTime) {
-			diff := targetTime.Sub(chunk.Timestamp)
-			if diff < bestDiff {
-				bestDiff = diff
-				bestIndex = index
+		best := sb.keyframes[0]
+		bestDiff := absDuration(sb.chunk(best).Timestamp.Sub(targetTime))
+		for _, seq := range sb.keyframes[1:] {
+			if diff := absDuration(sb.chunk(seq).Timestamp.Sub(targetTime)); diff < bestDiff {
+				best, bestDiff = seq, diff
 			}
 		}
+		return best, false
+	}
+
+	best := sb.firstSeq
+	for seq := sb.firstSeq; seq < sb.nextSeq; seq++ {
+		if sb.chunk(seq).Timestamp.After(targetTime) {
+			break
+		}
+		best = seq
+	}
+
+	return best, false
+}
+
+// prelude returns the tables a reader of an MPEG-TS stream starts with.
+func (sb *StreamBuffer) prelude() []byte {
+	if sb.ts == nil {
+		return nil
 	}
 
-	return bestIndex
+	return sb.ts.tables()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
 }
 
 // Read reads data from the buffer for a specific reader
@@ -215,44 +552,130 @@ func (br *BufferReader) Read(p []byte) (int, error) {
 	br.buffer.mutex.RLock()
 	defer br.buffer.mutex.RUnlock()
 
-	if br.buffer.closed {
+	sb := br.buffer
+	if sb.closed {
 		return 0, io.EOF
 	}
 
-	// Check if we need to wait for buffer delay
 	now := time.Now()
-	if br.readIndex < br.buffer.size {
-		chunk := br.buffer.chunks[(br.buffer.readIndex+br.readIndex)%br.buffer.capacity]
-		if chunk != nil {
-			timeSinceWrite := now.Sub(chunk.Timestamp)
-			if timeSinceWrite < br.buffer.bufferTime {
-				// Not enough time has passed, return no data for now
-				return 0, nil
-			}
-		}
+
+	if br.seq < sb.firstSeq {
+		// The reader fell behind the ring, it is resumed on a keyframe
+		log.Printf("[buffer] Reader %s overrun, resuming on a keyframe", br.id)
+		br.seq, br.offset = sb.firstSeq, 0
+		br.waitKeyframe = sb.ts != nil
+		br.created = now
 	}
 
-	if br.readIndex >= br.buffer.size {
+	// Skip to the first keyframe, a stream without keyframes starts anyway after maxKeyframeWait
+	for br.waitKeyframe && br.seq < sb.nextSeq {
+		if sb.ts == nil || sb.chunk(br.seq).Keyframe || now.Sub(br.created) > maxKeyframeWait {
+			br.waitKeyframe = false
+			br.prelude = sb.prelude()
+			break
+		}
+		br.seq++
+	}
+	if br.waitKeyframe || br.seq >= sb.nextSeq {
 		// No more data available
 		return 0, nil
 	}
 
-	chunkIndex := (br.buffer.readIndex + br.readIndex) % br.buffer.capacity
-	chunk := br.buffer.chunks[chunkIndex]
-	if chunk == nil {
+	// Check if we need to wait for buffer delay
+	chunk := sb.chunk(br.seq)
+	if now.Sub(chunk.Timestamp) < sb.bufferTime {
+		// Not enough time has passed, return no data for now
 		return 0, nil
 	}
 
-	bytesToCopy := len(chunk.Data)
-	if bytesToCopy > len(p) {
-		bytesToCopy = len(p)
+	br.lastRead = now
+	if len(br.prelude) > 0 {
+		n := copy(p, br.prelude)
+		br.prelude = br.prelude[n:]
+		return n, nil
 	}
 
-	copy(p[:bytesToCopy], chunk.Data[:bytesToCopy])
-	br.readIndex++
-	br.lastRead = now
+	n := copy(p, chunk.Data[br.offset:])
+	br.offset += n
+	if br.offset == len(chunk.Data) {
+		br.seq++
+		br.offset = 0
+	}
 
-	return bytesToCopy, nil
+	return n, nil
+}
+
+// wait waits for the buffer to change, at most maxReadWait.
+func (br *BufferReader) wait(ctx context.Context) {
+	br.buffer.mutex.RLock()
+	signal := br.buffer.signal
+	br.buffer.mutex.RUnlock()
+
+	timer := time.NewTimer(maxReadWait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-signal:
+	case <-timer.C:
+	}
+}
+
+// waitPreload waits until the buffer holds preload of the stream, at once if it already does.
+// The source error is returned if it failed before sending anything, errPreloadTimeout if it
+// sent nothing within preload and the stall timeout.
+func (sb *StreamBuffer) waitPreload(ctx context.Context, preload time.Duration) error {
+	timeout := time.NewTimer(preload + StallTimeout)
+	defer timeout.Stop()
+
+	for {
+		sb.mutex.RLock()
+		ready, received, closed, err, signal := sb.preloaded(preload), sb.nextSeq > 0 || len(sb.pending) > 0, sb.closed, sb.err, sb.signal
+		sb.mutex.RUnlock()
+
+		switch {
+		case err != nil:
+			return err
+		case ready:
+			return nil
+		case closed:
+			return io.ErrClosedPipe
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-signal:
+		case <-timeout.C:
+			if received {
+				// A slow source, played anyway
+				return nil
+			}
+			return errPreloadTimeout
+		}
+	}
+}
+
+// preloaded reports whether the buffer holds preload of the stream: the bytes of preload
+// at the ingest bitrate, or the data received over preload. The caller holds the buffer lock.
+func (sb *StreamBuffer) preloaded(preload time.Duration) bool {
+	if sb.nextSeq == 0 {
+		return false
+	}
+	if preload <= 0 {
+		return true
+	}
+
+	return float64(sb.totalBytes) >= sb.bitrate*preload.Seconds() || sb.lastWrite.Sub(sb.started) >= preload
+}
+
+// fail closes the buffer on an error of the source, returned to the readers waiting for the preload.
+func (sb *StreamBuffer) fail(err error) {
+	sb.mutex.Lock()
+	sb.err = err
+	sb.mutex.Unlock()
+
+	sb.Close()
 }
 
 // RemoveReader removes a reader from the buffer
@@ -265,6 +688,7 @@ func (sb *StreamBuffer) RemoveReader(id string) {
 
 	// If no readers left, we can consider closing the buffer
 	if len(sb.readers) == 0 {
+		sb.idleSince = time.Now()
 		go func() {
 			time.Sleep(30 * time.Second) // Grace period
 			sb.readersMutex.RLock()
@@ -289,6 +713,10 @@ func (sb *StreamBuffer) Close() error {
 
 	sb.closed = true
 	sb.cancel()
+	sb.broadcast()
+	if sb.recorder != nil {
+		sb.recorder.stop()
+	}
 
 	log.Printf("[buffer] Buffer closed, processed %d bytes total", sb.totalBytes)
 	return nil
@@ -318,13 +746,51 @@ func (sb *StreamBuffer) cleanupStaleReaders() {
 	staleThreshold := 2 * time.Minute
 
 	for id, reader := range sb.readers {
-		if now.Sub(reader.lastRead) > staleThreshold {
+		if !reader.passive && now.Sub(reader.lastRead) > staleThreshold {
 			delete(sb.readers, id)
 			log.Printf("[buffer] Removed stale reader %s", id)
+			if len(sb.readers) == 0 {
+				sb.idleSince = now
+			}
 		}
 	}
 }
 
+// readerCount returns the number of readers of the buffer
+func (sb *StreamBuffer) readerCount() int {
+	sb.readersMutex.RLock()
+	defer sb.readersMutex.RUnlock()
+
+	return len(sb.readers)
+}
+
+// idle returns how long the buffer has been without readers, false if it has some
+func (sb *StreamBuffer) idle(now time.Time) (time.Duration, bool) {
+	sb.readersMutex.RLock()
+	defer sb.readersMutex.RUnlock()
+
+	if len(sb.readers) > 0 {
+		return 0, false
+	}
+	return now.Sub(sb.idleSince), true
+}
+
+// memoryUsage returns the bytes held by the buffer
+func (sb *StreamBuffer) memoryUsage() int64 {
+	sb.mutex.RLock()
+	defer sb.mutex.RUnlock()
+
+	return sb.totalBytes + int64(len(sb.pending))
+}
+
+// setUpstreamAccount records the provider account the buffer is reading from
+func (sb *StreamBuffer) setUpstreamAccount(account string) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	sb.upstream = account
+}
+
 // Stats returns buffer statistics
 func (sb *StreamBuffer) Stats() map[string]interface{} {
 	sb.mutex.RLock()
@@ -334,11 +800,19 @@ func (sb *StreamBuffer) Stats() map[string]interface{} {
 	defer sb.readersMutex.RUnlock()
 
 	return map[string]interface{}{
-		"capacity":     sb.capacity,
-		"size":         sb.size,
-		"total_bytes":  sb.totalBytes,
-		"readers":      len(sb.readers),
-		"buffer_time":  sb.bufferTime.Seconds(),
-		"last_write":   sb.lastWrite,
+		"capacity":         sb.capacity,
+		"size":             sb.nextSeq - sb.firstSeq,
+		"total_bytes":      sb.totalBytes,
+		"max_memory":       sb.maxMemory,
+		"bitrate":          int64(sb.bitrate * 8),
+		"bitrate_measured": sb.measured,
+		"mpegts":           sb.ts != nil,
+		"keyframes":        len(sb.keyframes),
+		"dropped_bytes":    sb.droppedBytes,
+		"reconnects":       sb.reconnects,
+		"readers":          len(sb.readers),
+		"buffer_time":      sb.bufferTime.Seconds(),
+		"last_write":       sb.lastWrite,
+		"upstream_account": sb.upstream,
 	}
 }
\ No newline at end of file
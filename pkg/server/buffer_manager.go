@@ -20,21 +20,67 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+// StallTimeout is how long a source can go without sending data before it is considered stalled
+var StallTimeout = 15 * time.Second
+
+// Delays between the reconnections to a source, doubled on each attempt until
+// a connection streams for reconnectStableTime
+var (
+	reconnectMinDelay   = 500 * time.Millisecond
+	reconnectMaxDelay   = 30 * time.Second
+	reconnectStableTime = 10 * time.Second
+)
+
+var errUpstreamUnavailable = errors.New("upstream unavailable")
+
+// upstreamStatusError is the error status answered by the source,
+// errUpstreamUnavailable if another account should be tried.
+type upstreamStatusError struct {
+	status   int
+	failover bool
+}
+
+func (e *upstreamStatusError) Error() string {
+	if e.failover {
+		return fmt.Sprintf("%v: source returned status %d", errUpstreamUnavailable, e.status)
+	}
+	return fmt.Sprintf("source returned status %d", e.status)
+}
+
+func (e *upstreamStatusError) Unwrap() error {
+	if e.failover {
+		return errUpstreamUnavailable
+	}
+	return nil
+}
+
+// memoryCheckInterval is the interval the memory budget of the buffers is checked at
+var memoryCheckInterval = 5 * time.Second
+
 // BufferManager manages multiple stream buffers
 type BufferManager struct {
 	buffers      map[string]*StreamBuffer
 	buffersMutex sync.RWMutex
 	bufferTime   time.Duration
+	// memory cap of each buffer and budget of all of them in bytes,
+	// the idle buffers are evicted when the budget is exceeded, no budget if zero
+	maxMemory    int64
+	totalMemory  int64
+	// records the buffered streams on disk, nil if timeshift is disabled
+	timeshift    *timeshiftStore
 }
 
 // StreamInfo contains information about a buffered stream
@@ -55,7 +101,9 @@ func GetBufferManager() *BufferManager {
 		globalBufferManager = &BufferManager{
 			buffers:    make(map[string]*StreamBuffer),
 			bufferTime: DefaultBufferDuration,
+			maxMemory:  DefaultMaxBufferMemory,
 		}
+		go globalBufferManager.watchMemory()
 	})
 	return globalBufferManager
 }
@@ -65,6 +113,82 @@ func (bm *BufferManager) SetBufferDuration(duration time.Duration) {
 	bm.bufferTime = duration
 }
 
+// SetMemoryLimits sets the memory cap of the new buffers and the budget of all the buffers in bytes,
+// DefaultMaxBufferMemory is used for a cap not positive and a budget not positive disables it.
+func (bm *BufferManager) SetMemoryLimits(maxMemory, totalMemory int64) {
+	bm.buffersMutex.Lock()
+	defer bm.buffersMutex.Unlock()
+
+	if maxMemory <= 0 {
+		maxMemory = DefaultMaxBufferMemory
+	}
+	bm.maxMemory = maxMemory
+	bm.totalMemory = totalMemory
+}
+
+// setTimeshift records the new buffers in the timeshift store, nil disables the recording
+func (bm *BufferManager) setTimeshift(store *timeshiftStore) {
+	bm.buffersMutex.Lock()
+	defer bm.buffersMutex.Unlock()
+
+	bm.timeshift = store
+}
+
+// watchMemory evicts the idle buffers while the memory budget is exceeded
+func (bm *BufferManager) watchMemory() {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		bm.buffersMutex.Lock()
+		bm.evictIdleBuffers(0)
+		bm.buffersMutex.Unlock()
+	}
+}
+
+// evictIdleBuffers closes the buffers without readers, the longest idle first, until
+// the buffers and reserve more bytes fit in the memory budget. The caller holds buffersMutex.
+func (bm *BufferManager) evictIdleBuffers(reserve int64) int {
+	if bm.totalMemory <= 0 {
+		return 0
+	}
+
+	type idleBuffer struct {
+		url    string
+		buffer *StreamBuffer
+		idle   time.Duration
+	}
+
+	now := time.Now()
+	used := reserve
+	idle := make([]idleBuffer, 0)
+	for url, buffer := range bm.buffers {
+		used += buffer.memoryUsage()
+		if d, ok := buffer.idle(now); ok {
+			idle = append(idle, idleBuffer{url: url, buffer: buffer, idle: d})
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].idle > idle[j].idle })
+
+	evicted := 0
+	for _, b := range idle {
+		if used <= bm.totalMemory {
+			break
+		}
+		used -= b.buffer.memoryUsage()
+		b.buffer.Close()
+		delete(bm.buffers, b.url)
+		evicted++
+		log.Printf("[buffer-manager] Evicted buffer idle for %v to fit the memory budget: %s", b.idle.Round(time.Second), b.url)
+	}
+
+	if used > bm.totalMemory && reserve > 0 {
+		log.Printf("[buffer-manager] Buffers memory budget of %dMB exceeded by the streams being read", bm.totalMemory/(1024*1024))
+	}
+
+	return evicted
+}
+
 // GetOrCreateBuffer gets an existing buffer or creates a new one for a stream URL
 func (bm *BufferManager) GetOrCreateBuffer(streamURL string, headers http.Header) (*StreamBuffer, error) {
 	bm.buffersMutex.Lock()
@@ -75,48 +199,154 @@ func (bm *BufferManager) GetOrCreateBuffer(streamURL string, headers http.Header
 		return buffer, nil
 	}
 
-	// Create new buffer
+	// Make room for the new buffer
+	bm.evictIdleBuffers(bm.maxMemory)
+
+	// Create new buffer, it holds a single upstream connection shared by all its readers
 	buffer := NewStreamBuffer(bm.bufferTime)
+	buffer.setMaxMemory(bm.maxMemory)
+	if bm.timeshift != nil {
+		buffer.recorder = bm.timeshift.channel(streamURL).newRecorder()
+	}
+	lease, err := GetConnectionAccountant().Acquire(streamURL, func() { buffer.Close() })
+	if err != nil {
+		buffer.Close()
+		return nil, err
+	}
 	bm.buffers[streamURL] = buffer
 
 	// Start buffering from the source
-	go bm.startBuffering(streamURL, buffer, headers)
+	go bm.startBuffering(streamURL, buffer, headers, lease)
 
 	log.Printf("[buffer-manager] Created new buffer for stream: %s", streamURL)
 	return buffer, nil
 }
 
-// startBuffering starts the buffering process for a stream
-func (bm *BufferManager) startBuffering(streamURL string, buffer *StreamBuffer, headers http.Header) {
+// startBuffering starts the buffering process for a stream,
+// switching to the next provider account when the upstream fails.
+func (bm *BufferManager) startBuffering(streamURL string, buffer *StreamBuffer, headers http.Header, lease *ConnectionLease) {
+	accountant := GetConnectionAccountant()
 	defer func() {
 		bm.buffersMutex.Lock()
-		delete(bm.buffers, streamURL)
+		// The buffer may have been evicted and replaced already
+		if bm.buffers[streamURL] == buffer {
+			delete(bm.buffers, streamURL)
+		}
 		bm.buffersMutex.Unlock()
 		buffer.Close()
+		accountant.Release(lease)
 		log.Printf("[buffer-manager] Stopped buffering for stream: %s", streamURL)
 	}()
 
+	buffer.setUpstreamAccount(accountant.Account(lease))
+	failures := 0
 	for {
-		select {
-		case <-buffer.ctx.Done():
+		bytesIn := atomic.LoadInt64(&buffer.bytesIn)
+		start := time.Now()
+		err := bm.bufferFromSource(lease.URL, buffer, headers)
+		if buffer.ctx.Err() != nil {
 			return
-		default:
-			if err := bm.bufferFromSource(streamURL, buffer, headers); err != nil {
-				log.Printf("[buffer-manager] Error buffering from source %s: %v", streamURL, err)
-				time.Sleep(5 * time.Second) // Wait before retry
+		}
+
+		// A source which was streaming is reconnected at once, the next attempts are spaced out
+		if atomic.LoadInt64(&buffer.bytesIn) > bytesIn && time.Since(start) >= reconnectStableTime {
+			failures = 0
+		} else {
+			failures++
+		}
+		// The readers resume on the next keyframe of the new connection
+		buffer.discontinuity()
+
+		if err != nil {
+			log.Printf("[buffer-manager] Error buffering from source %s: %v", streamURL, err)
+		}
+
+		// Until the source sends something, the viewers waiting for the stream
+		// are told why it failed rather than kept waiting for the reconnections
+		received := atomic.LoadInt64(&buffer.bytesIn) > 0
+		if err != nil && !received && !errors.Is(err, errUpstreamUnavailable) {
+			buffer.fail(err)
+			return
+		}
+
+		if errors.Is(err, errUpstreamUnavailable) {
+			if next, failoverErr := accountant.Failover(lease); failoverErr == nil {
+				lease = next
+				buffer.setUpstreamAccount(accountant.Account(lease))
 				continue
 			}
+			if !received {
+				buffer.fail(err)
+				return
+			}
+
+			// No other account available, start over from the first one
+			if !sleepContext(buffer.ctx, reconnectDelay(failures)) {
+				return
+			}
+			next, err := accountant.Acquire(streamURL, func() { buffer.Close() })
+			if err != nil {
+				log.Printf("[buffer-manager] No upstream account available for %s: %v", streamURL, err)
+				return
+			}
+			lease = next
+			buffer.setUpstreamAccount(accountant.Account(lease))
+			continue
+		}
+
+		if !sleepContext(buffer.ctx, reconnectDelay(failures)) {
+			return
 		}
 	}
 }
 
-// bufferFromSource connects to the source and buffers data
-func (bm *BufferManager) bufferFromSource(streamURL string, buffer *StreamBuffer, headers http.Header) error {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// reconnectDelay returns the delay before reconnecting to a source after failures
+// attempts without data, the first reconnection is immediate.
+func reconnectDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
 	}
 
-	req, err := http.NewRequest("GET", streamURL, nil)
+	delay := reconnectMinDelay
+	for i := 1; i < failures && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return delay
+}
+
+// sleepContext waits for d, false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// bufferFromSource connects to the source and buffers data,
+// errUpstreamUnavailable is returned when another account should be tried.
+func (bm *BufferManager) bufferFromSource(streamURL string, buffer *StreamBuffer, headers http.Header) error {
+	client := &http.Client{}
+
+	ctx, cancel := context.WithCancel(buffer.ctx)
+	defer cancel()
+
+	// Cancel the request if the source does not send anything for too long
+	watchdog := time.AfterFunc(StallTimeout, cancel)
+	defer watchdog.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
@@ -128,14 +358,23 @@ func (bm *BufferManager) bufferFromSource(streamURL string, buffer *StreamBuffer
 		}
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
+	if buffer.ctx.Err() != nil {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to source: %v", err)
+		GetMetrics().UpstreamError(0)
+		return fmt.Errorf("%w: failed to connect to source: %v", errUpstreamUnavailable, err)
 	}
 	defer resp.Body.Close()
 
+	GetMetrics().ObserveConnect(time.Since(start))
+	if resp.StatusCode >= http.StatusBadRequest {
+		GetMetrics().UpstreamError(resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("source returned status %d", resp.StatusCode)
+		return &upstreamStatusError{status: resp.StatusCode, failover: failoverStatus(resp.StatusCode)}
 	}
 
 	log.Printf("[buffer-manager] Connected to source %s, status: %d", streamURL, resp.StatusCode)
@@ -149,6 +388,9 @@ func (bm *BufferManager) bufferFromSource(streamURL string, buffer *StreamBuffer
 		default:
 			n, err := resp.Body.Read(buf)
 			if n > 0 {
+				watchdog.Reset(StallTimeout)
+				atomic.AddInt64(&buffer.bytesIn, int64(n))
+				GetMetrics().AddBytesIn(n)
 				if _, writeErr := buffer.Write(buf[:n]); writeErr != nil {
 					log.Printf("[buffer-manager] Error writing to buffer: %v", writeErr)
 					return writeErr
@@ -159,7 +401,13 @@ func (bm *BufferManager) bufferFromSource(streamURL string, buffer *StreamBuffer
 					log.Printf("[buffer-manager] Source stream ended for %s", streamURL)
 					return nil
 				}
-				return fmt.Errorf("error reading from source: %v", err)
+				if buffer.ctx.Err() != nil {
+					return nil
+				}
+				if ctx.Err() != nil {
+					return fmt.Errorf("%w: source stalled for %v", errUpstreamUnavailable, StallTimeout)
+				}
+				return fmt.Errorf("%w: error reading from source: %v", errUpstreamUnavailable, err)
 			}
 		}
 	}
@@ -178,6 +426,24 @@ func (bm *BufferManager) GetBufferReader(streamURL string, headers http.Header)
 	return reader, nil
 }
 
+// HoldBuffer keeps the buffer of a stream open, and recorded, without reading it until the returned writer is closed
+func (bm *BufferManager) HoldBuffer(streamURL string, headers http.Header) (*BufferedStreamWriter, error) {
+	buffer, err := bm.GetOrCreateBuffer(streamURL, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := buffer.NewReader(uuid.NewV4().String())
+	buffer.readersMutex.Lock()
+	reader.passive = true
+	buffer.readersMutex.Unlock()
+
+	return &BufferedStreamWriter{
+		reader:    reader,
+		streamURL: streamURL,
+	}, nil
+}
+
 // RemoveBuffer removes a buffer (called when no more readers)
 func (bm *BufferManager) RemoveBuffer(streamURL string) {
 	bm.buffersMutex.Lock()
@@ -190,6 +456,21 @@ func (bm *BufferManager) RemoveBuffer(streamURL string) {
 	}
 }
 
+// CloseAll closes all buffers, stopping their upstream connections
+func (bm *BufferManager) CloseAll() {
+	bm.buffersMutex.RLock()
+	buffers := make([]*StreamBuffer, 0, len(bm.buffers))
+	for _, buffer := range bm.buffers {
+		buffers = append(buffers, buffer)
+	}
+	bm.buffersMutex.RUnlock()
+
+	for _, buffer := range buffers {
+		buffer.Close()
+	}
+	log.Printf("[buffer-manager] Closed %d buffers", len(buffers))
+}
+
 // GetStats returns statistics for all buffers
 func (bm *BufferManager) GetStats() map[string]interface{} {
 	bm.buffersMutex.RLock()
@@ -198,16 +479,50 @@ func (bm *BufferManager) GetStats() map[string]interface{} {
 	stats := map[string]interface{}{
 		"total_buffers": len(bm.buffers),
 		"buffer_time":   bm.bufferTime.Seconds(),
+		"max_memory":    bm.maxMemory,
+		"total_memory":  bm.totalMemory,
 		"buffers":       make(map[string]interface{}),
 	}
 
+	var memory int64
 	for url, buffer := range bm.buffers {
 		stats["buffers"].(map[string]interface{})[url] = buffer.Stats()
+		memory += buffer.memoryUsage()
 	}
+	stats["memory"] = memory
 
 	return stats
 }
 
+// bufferMetrics are the metrics of a stream buffer
+type bufferMetrics struct {
+	url      string
+	readers  int
+	bytesIn  int64
+	bytesOut int64
+	memory   int64
+}
+
+// metrics returns the metrics of all buffers
+func (bm *BufferManager) metrics() []bufferMetrics {
+	bm.buffersMutex.RLock()
+	defer bm.buffersMutex.RUnlock()
+
+	metrics := make([]bufferMetrics, 0, len(bm.buffers))
+	for url, buffer := range bm.buffers {
+		metrics = append(metrics, bufferMetrics{
+			url:      url,
+			readers:  buffer.readerCount(),
+			bytesIn:  atomic.LoadInt64(&buffer.bytesIn),
+			bytesOut: atomic.LoadInt64(&buffer.bytesOut),
+			memory:   buffer.memoryUsage(),
+		})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].url < metrics[j].url })
+
+	return metrics
+}
+
 // BufferedStreamWriter wraps a BufferReader to implement io.Writer interface for gin.Context.Stream
 type BufferedStreamWriter struct {
 	reader   *BufferReader
@@ -230,7 +545,12 @@ func NewBufferedStreamWriter(streamURL string, headers http.Header) (*BufferedSt
 
 // Read implements io.Reader interface
 func (bsw *BufferedStreamWriter) Read(p []byte) (int, error) {
-	return bsw.reader.Read(p)
+	n, err := bsw.reader.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&bsw.reader.buffer.bytesOut, int64(n))
+		GetMetrics().AddBytesOut(n)
+	}
+	return n, err
 }
 
 // Close cleans up the reader
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeAt writes size bytes of a raw stream in chunks to the buffer every interval from start
+func writeAt(sb *StreamBuffer, start time.Time, interval time.Duration, writes, size int) time.Time {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	data := bytes.Repeat([]byte("a"), size)
+	for i := 0; i < writes; i++ {
+		sb.write(data, start)
+		start = start.Add(interval)
+	}
+	return start
+}
+
+func TestStreamBufferSizing(t *testing.T) {
+	t.Run("A high bitrate stream is capped by the memory", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+		sb.setMaxMemory(1024 * 1024)
+
+		// 3.2MB/s for 4s
+		writeAt(sb, time.Now(), 10*time.Millisecond, 400, DefaultChunkSize)
+
+		if sb.totalBytes > sb.maxMemory {
+			t.Errorf("Expected the buffer to hold at most %d bytes, got %d", sb.maxMemory, sb.totalBytes)
+		}
+		if !sb.measured || sb.bitrate < 3*1024*1024 {
+			t.Errorf("Expected a measured bitrate of 3.2MB/s, got %.0f", sb.bitrate)
+		}
+		if want := 32; sb.capacity != want {
+			t.Errorf("Expected the ring to be sized for the memory cap, %d chunks, got %d", want, sb.capacity)
+		}
+	})
+
+	t.Run("A low bitrate stream holds the buffer duration", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+		initial := sb.capacity
+
+		// 16KB/s in 4KB writes for 12s
+		end := writeAt(sb, time.Now(), 250*time.Millisecond, 48, 4096)
+
+		// 4 chunks per second for the 5s and the margin
+		if want := 32; sb.capacity != want || sb.capacity >= initial {
+			t.Errorf("Expected the ring to shrink from %d to %d chunks, got %d", initial, want, sb.capacity)
+		}
+		if held := end.Sub(sb.chunk(sb.firstSeq).Timestamp); held < sb.bufferTime {
+			t.Errorf("Expected the buffer to hold %v of the stream, got %v", sb.bufferTime, held)
+		}
+	})
+
+	t.Run("Readers keep their position across a resize", func(t *testing.T) {
+		sb := NewStreamBuffer(0)
+		sb.bufferTime = 0
+		defer sb.Close()
+
+		start := writeAt(sb, time.Now().Add(-time.Minute), time.Millisecond, 1, 4096)
+		reader := sb.NewReader("resize")
+		defer sb.RemoveReader("resize")
+
+		sb.mutex.Lock()
+		sb.resize(sb.capacity * 2)
+		sb.mutex.Unlock()
+		writeAt(sb, start, time.Millisecond, 1, 4096)
+
+		if got := readAvailable(t, reader); len(got) != 2*4096 {
+			t.Errorf("Expected to read the 2 writes, got %d bytes", len(got))
+		}
+	})
+}
+
+func TestBufferMemoryBudget(t *testing.T) {
+	bm := &BufferManager{
+		buffers:     make(map[string]*StreamBuffer),
+		bufferTime:  time.Second,
+		maxMemory:   DefaultMaxBufferMemory,
+		totalMemory: 250 * 1024,
+	}
+
+	now := time.Now()
+	newBuffer := func(url string, idle time.Duration) *StreamBuffer {
+		sb := NewStreamBuffer(time.Second)
+		writeAt(sb, now, time.Millisecond, 1, 100*1024)
+		sb.idleSince = now.Add(-idle)
+		bm.buffers[url] = sb
+		return sb
+	}
+	oldest := newBuffer("http://example.com/oldest", time.Minute)
+	defer oldest.Close()
+	idle := newBuffer("http://example.com/idle", time.Second)
+	defer idle.Close()
+	active := newBuffer("http://example.com/active", time.Hour)
+	defer active.Close()
+	active.NewReader("viewer")
+	defer active.RemoveReader("viewer")
+
+	if evicted := bm.evictIdleBuffers(0); evicted != 1 || oldest.ctx.Err() == nil || bm.buffers["http://example.com/oldest"] != nil {
+		t.Errorf("Expected the longest idle buffer to be evicted, %d evicted", evicted)
+	}
+	if idle.ctx.Err() != nil || active.ctx.Err() != nil {
+		t.Error("Expected the other buffers to be kept once within the budget")
+	}
+
+	// A new stream needs room for its memory
+	if evicted := bm.evictIdleBuffers(200 * 1024); evicted != 1 || idle.ctx.Err() == nil {
+		t.Errorf("Expected the idle buffer to be evicted for the new stream, %d evicted", evicted)
+	}
+	if evicted := bm.evictIdleBuffers(200 * 1024); evicted != 0 || active.ctx.Err() != nil {
+		t.Error("Expected a buffer being read never to be evicted")
+	}
+
+	stats := bm.GetStats()
+	if stats["memory"] != int64(100*1024) || stats["total_memory"] != int64(250*1024) {
+		t.Errorf("Unexpected memory stats %v", stats)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	for failures, want := range []time.Duration{0, 500 * time.Millisecond, time.Second, 2 * time.Second} {
+		if got := reconnectDelay(failures); got != want {
+			t.Errorf("reconnectDelay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+	if got := reconnectDelay(20); got != reconnectMaxDelay {
+		t.Errorf("Expected the delay to be capped to %v, got %v", reconnectMaxDelay, got)
+	}
+}
+
+func TestBufferReconnect(t *testing.T) {
+	defer func(stable time.Duration) { reconnectStableTime = stable }(reconnectStableTime)
+	reconnectStableTime = 0
+
+	done := make(chan struct{})
+
+	var connections int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := append(testPAT(), testPMT()...)
+		stream = append(stream, testVideoPES(true)...)
+		stream = append(stream, testVideoData()...)
+		w.Write(stream) // nolint: errcheck
+
+		// The first connection ends, the second one stays open
+		if atomic.AddInt32(&connections, 1) > 1 {
+			w.(http.Flusher).Flush()
+			<-done
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	bm := &BufferManager{
+		buffers:    make(map[string]*StreamBuffer),
+		bufferTime: time.Millisecond,
+		maxMemory:  DefaultMaxBufferMemory,
+	}
+	reader, err := bm.GetBufferReader(upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.buffer.Close()
+
+	deadline := time.Now().Add(time.Second)
+	out := &bytes.Buffer{}
+	buf := make([]byte, 1024)
+	for !bytes.Contains(out.Bytes(), tsDiscontinuityPacket(testVideoPID)) && time.Now().Before(deadline) {
+		n, _ := reader.Read(buf)
+		out.Write(buf[:n])
+		if n == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Errorf("Expected an immediate reconnection, got %d connections", n)
+	}
+	if !bytes.Contains(out.Bytes(), tsDiscontinuityPacket(testVideoPID)) {
+		t.Fatalf("Expected the reader to get the discontinuity, got %d bytes", out.Len())
+	}
+	if stats := reader.buffer.Stats(); stats["reconnects"] != int64(1) {
+		t.Errorf("Expected 1 reconnection, got %v", stats["reconnects"])
+	}
+}
+
+func TestStreamBufferPreload(t *testing.T) {
+	defer func(timeout time.Duration) { StallTimeout = timeout }(StallTimeout)
+	StallTimeout = 100 * time.Millisecond
+	ctx := context.Background()
+
+	t.Run("The preload is the bytes of its duration at the bitrate", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+
+		// 10KB/s measured over 2s
+		writeAt(sb, time.Now().Add(-2*time.Second), 100*time.Millisecond, 21, 1000)
+		sb.mutex.RLock()
+		defer sb.mutex.RUnlock()
+		if !sb.preloaded(2 * time.Second) {
+			t.Error("Expected 2s of the stream to be preloaded")
+		}
+		if sb.preloaded(5 * time.Second) {
+			t.Error("Expected 5s of the stream not to be preloaded")
+		}
+	})
+
+	t.Run("A slow source is preloaded after the preload duration", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+
+		writeAt(sb, time.Now().Add(-3*time.Second), time.Second, 4, 10)
+		sb.mutex.RLock()
+		defer sb.mutex.RUnlock()
+		if !sb.preloaded(2 * time.Second) {
+			t.Error("Expected the data received over 2s to be preloaded")
+		}
+	})
+
+	t.Run("A warm buffer is played at once", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+
+		writeAt(sb, time.Now().Add(-10*time.Second), 100*time.Millisecond, 101, 1000)
+		start := time.Now()
+		if err := sb.waitPreload(ctx, 5*time.Second); err != nil || time.Since(start) > 50*time.Millisecond {
+			t.Errorf("Expected no wait, got %v after %v", err, time.Since(start))
+		}
+	})
+
+	t.Run("The source error is returned", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		sourceErr := &upstreamStatusError{status: http.StatusNotFound}
+		time.AfterFunc(10*time.Millisecond, func() { sb.fail(sourceErr) })
+
+		var statusErr *upstreamStatusError
+		if err := sb.waitPreload(ctx, 5*time.Second); !errors.As(err, &statusErr) || statusErr.status != http.StatusNotFound {
+			t.Errorf("Expected the upstream status, got %v", err)
+		}
+	})
+
+	t.Run("A silent source times out", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+
+		if err := sb.waitPreload(ctx, 100*time.Millisecond); err != errPreloadTimeout {
+			t.Errorf("Expected the preload to time out, got %v", err)
+		}
+	})
+
+	t.Run("A source stalling during the preload is played", func(t *testing.T) {
+		sb := NewStreamBuffer(5 * time.Second)
+		defer sb.Close()
+
+		if _, err := sb.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sb.waitPreload(ctx, 100*time.Millisecond); err != nil {
+			t.Errorf("Expected the received data to be played, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,356 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+// ErrMaxConnections is returned when the provider connection limit is reached.
+var ErrMaxConnections = errors.New("maximum upstream connections reached")
+
+// UpstreamAccount is a provider account and its connection limit
+type UpstreamAccount struct {
+	config.XtreamAccount
+	// Limit is the maximum concurrent streams, unlimited if zero
+	Limit int
+}
+
+// ConnectionAccountant counts the streams opened against the provider accounts,
+// and picks the account serving each stream.
+type ConnectionAccountant struct {
+	mutex    sync.Mutex
+	accounts []UpstreamAccount
+	preempt  bool
+	nextID   int
+	leases   map[int]*ConnectionLease
+}
+
+// ConnectionLease is an open upstream stream
+type ConnectionLease struct {
+	// URL is the upstream url rewritten for the account of the lease
+	URL string
+
+	id        int
+	streamURL string
+	account   int
+	started   time.Time
+	cancel    func()
+	released  bool
+}
+
+var globalConnectionAccountant *ConnectionAccountant
+var connectionAccountantOnce sync.Once
+
+// GetConnectionAccountant returns the global connection accountant instance
+func GetConnectionAccountant() *ConnectionAccountant {
+	connectionAccountantOnce.Do(func() {
+		globalConnectionAccountant = newConnectionAccountant()
+	})
+	return globalConnectionAccountant
+}
+
+func newConnectionAccountant() *ConnectionAccountant {
+	return &ConnectionAccountant{
+		accounts: []UpstreamAccount{{}},
+		leases:   make(map[int]*ConnectionLease),
+	}
+}
+
+// SetAccounts sets the ordered provider accounts, and whether the oldest stream
+// is stopped to make room for a new one when all the accounts are full.
+// An account without credentials matches every stream.
+func (ca *ConnectionAccountant) SetAccounts(accounts []UpstreamAccount, preempt bool) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if len(accounts) == 0 {
+		accounts = []UpstreamAccount{{}}
+	}
+	ca.accounts = accounts
+	ca.preempt = preempt
+}
+
+// SetLimit sets the connection limit of the account, once known.
+func (ca *ConnectionAccountant) SetLimit(account config.XtreamAccount, limit int) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	for i := range ca.accounts {
+		if ca.accounts[i].XtreamAccount == account {
+			ca.accounts[i].Limit = limit
+		}
+	}
+}
+
+// Acquire registers a new upstream stream on the first account with a free connection,
+// cancel is called if the stream is preempted.
+// The lease must be released when the stream ends.
+func (ca *ConnectionAccountant) Acquire(streamURL string, cancel func()) (*ConnectionLease, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ca.acquire(streamURL, cancel, -1)
+}
+
+// Failover releases the lease and acquires a new one on the next account,
+// ErrMaxConnections is returned if there is no other account available.
+func (ca *ConnectionAccountant) Failover(lease *ConnectionLease) (*ConnectionLease, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.release(lease)
+	if lease.account < 0 {
+		return nil, ErrMaxConnections
+	}
+
+	next, err := ca.acquire(lease.streamURL, lease.cancel, lease.account)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[connections] Switching %s from account %s to %s", ca.redact(lease.streamURL), ca.accounts[lease.account], ca.accounts[next.account])
+	return next, nil
+}
+
+// acquire registers a lease on the first account after the account index after,
+// the caller must hold the lock.
+func (ca *ConnectionAccountant) acquire(streamURL string, cancel func(), after int) (*ConnectionLease, error) {
+	from := ca.accountOf(streamURL)
+	if from < 0 {
+		// not a stream of our provider accounts
+		return ca.newLease(streamURL, streamURL, -1, cancel), nil
+	}
+
+	full := -1
+	for i := after + 1; i < len(ca.accounts); i++ {
+		if ca.accounts[i].Limit > 0 && ca.activeOn(i) >= ca.accounts[i].Limit {
+			if full < 0 {
+				full = i
+			}
+			continue
+		}
+		return ca.newLease(streamURL, ca.rewrite(streamURL, from, i), i, cancel), nil
+	}
+
+	if !ca.preempt || full < 0 {
+		return nil, ErrMaxConnections
+	}
+
+	oldest := ca.oldest(full)
+	ca.release(oldest)
+	log.Printf("[connections] Limit of account %s reached, stopping oldest stream %s", ca.accounts[full], ca.redact(oldest.streamURL))
+	go oldest.cancel()
+
+	return ca.newLease(streamURL, ca.rewrite(streamURL, from, full), full, cancel), nil
+}
+
+func (ca *ConnectionAccountant) newLease(streamURL, upstreamURL string, account int, cancel func()) *ConnectionLease {
+	ca.nextID++
+	lease := &ConnectionLease{
+		URL:       upstreamURL,
+		id:        ca.nextID,
+		streamURL: streamURL,
+		account:   account,
+		started:   time.Now(),
+		cancel:    cancel,
+	}
+	ca.leases[lease.id] = lease
+
+	return lease
+}
+
+// Release unregisters the lease
+func (ca *ConnectionAccountant) Release(lease *ConnectionLease) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.release(lease)
+}
+
+func (ca *ConnectionAccountant) release(lease *ConnectionLease) {
+	lease.released = true
+	delete(ca.leases, lease.id)
+}
+
+// CancelAll cancels all the upstream streams
+func (ca *ConnectionAccountant) CancelAll() {
+	ca.mutex.Lock()
+	cancels := make([]func(), 0, len(ca.leases))
+	for _, lease := range ca.leases {
+		cancels = append(cancels, lease.cancel)
+	}
+	ca.mutex.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// accountOf returns the index of the account of streamURL, -1 if none.
+func (ca *ConnectionAccountant) accountOf(streamURL string) int {
+	for i, account := range ca.accounts {
+		if account.Match(streamURL) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rewrite returns streamURL with the credentials of the account to instead of from.
+func (ca *ConnectionAccountant) rewrite(streamURL string, from, to int) string {
+	if from == to {
+		return streamURL
+	}
+	return ca.accounts[from].Rewrite(streamURL, ca.accounts[to].XtreamAccount)
+}
+
+// activeOn returns the number of leases of the account, the caller must hold the lock
+func (ca *ConnectionAccountant) activeOn(account int) int {
+	n := 0
+	for _, lease := range ca.leases {
+		if lease.account == account {
+			n++
+		}
+	}
+	return n
+}
+
+// oldest returns the oldest lease of the account, the caller must hold the lock
+func (ca *ConnectionAccountant) oldest(account int) *ConnectionLease {
+	var oldest *ConnectionLease
+	for _, lease := range ca.leases {
+		if lease.account != account {
+			continue
+		}
+		if oldest == nil || lease.started.Before(oldest.started) {
+			oldest = lease
+		}
+	}
+	return oldest
+}
+
+// Account returns the name of the account of the lease
+func (ca *ConnectionAccountant) Account(lease *ConnectionLease) string {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if lease.account < 0 {
+		return ""
+	}
+	return ca.accounts[lease.account].String()
+}
+
+// Redact returns streamURL without the provider credentials and query,
+// to be used as a metric label or in the logs and the stats.
+func (ca *ConnectionAccountant) Redact(streamURL string) string {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ca.redact(streamURL)
+}
+
+// redact is Redact for the callers holding the lock.
+func (ca *ConnectionAccountant) redact(streamURL string) string {
+	if i := strings.Index(streamURL, "?"); i >= 0 {
+		streamURL = streamURL[:i]
+	}
+	for _, account := range ca.accounts {
+		if account.User != "" {
+			streamURL = strings.Replace(streamURL, "/"+account.User.String()+"/"+account.Password.String()+"/", "/", 1)
+		}
+	}
+
+	return streamURL
+}
+
+// Limit returns the total connection limit of the accounts, zero if unlimited
+func (ca *ConnectionAccountant) Limit() int {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	total := 0
+	for _, account := range ca.accounts {
+		if account.Limit <= 0 {
+			return 0
+		}
+		total += account.Limit
+	}
+
+	return total
+}
+
+// Active returns the number of open upstream streams
+func (ca *ConnectionAccountant) Active() int {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return len(ca.leases)
+}
+
+// Stats returns connection statistics
+func (ca *ConnectionAccountant) Stats() map[string]interface{} {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	accounts := make([]map[string]interface{}, 0, len(ca.accounts))
+	for i, account := range ca.accounts {
+		streams := make([]string, 0)
+		for _, lease := range ca.leases {
+			if lease.account == i {
+				streams = append(streams, ca.redact(lease.streamURL))
+			}
+		}
+
+		accounts = append(accounts, map[string]interface{}{
+			"account": account.String(),
+			"active":  len(streams),
+			"limit":   account.Limit,
+			"streams": streams,
+		})
+	}
+
+	return map[string]interface{}{
+		"active":   len(ca.leases),
+		"preempt":  ca.preempt,
+		"accounts": accounts,
+	}
+}
+
+// failoverStatus reports whether an upstream status code means the stream
+// should be retried on another account.
+func failoverStatus(code int) bool {
+	return code == http.StatusUnauthorized || code >= http.StatusInternalServerError
+}
+
+// String returns the account name, without its password
+func (a UpstreamAccount) String() string {
+	if a.User == "" {
+		return "default"
+	}
+	return fmt.Sprintf("%s@%s", a.User, strings.TrimPrefix(strings.TrimPrefix(a.BaseURL, "http://"), "https://"))
+}
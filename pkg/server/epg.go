@@ -0,0 +1,131 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	xtream "github.com/incmve/iptv-proxy/pkg/xtream-codes-fixed"
+)
+
+// epgTimeLayout is the layout of the start and end times of the xtream EPG listings.
+const epgTimeLayout = "2006-01-02 15:04:05"
+
+// epgOffsets holds the guide offset of the playlist channels, by tvg-id.
+// It is swapped as a whole each time the playlist is refreshed.
+type epgOffsets struct {
+	sync.RWMutex
+	offsets map[string]time.Duration
+}
+
+func newEPGOffsets() *epgOffsets {
+	return &epgOffsets{}
+}
+
+func (o *epgOffsets) set(offsets map[string]time.Duration) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.offsets = offsets
+}
+
+func (o *epgOffsets) get() map[string]time.Duration {
+	if o == nil {
+		return nil
+	}
+
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.offsets
+}
+
+// channelEPGOffsets returns the guide offsets of the channels by tvg-id, nil if no rule shifts the guide.
+// The offsets of the provider channels are derived from its live streams, the rules
+// matching the group as the category name.
+func (c *Config) channelEPGOffsets(ctx *gin.Context) (map[string]time.Duration, error) {
+	if !c.rules.HasEPGOffsets() {
+		return nil, nil
+	}
+
+	if c.XtreamBaseURL == "" {
+		return c.epgOffsets.get(), nil
+	}
+
+	client, err := c.xtreamClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks, err := c.xtreamLiveTracks(client, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.rules.EPGOffsets(tracks), nil
+}
+
+// shiftEPGResponse shifts the listings of a get_short_epg or get_simple_data_table response.
+func (c *Config) shiftEPGResponse(ctx *gin.Context, resp interface{}) error {
+	listings, ok := resp.([]xtream.EPGInfo)
+	if !ok || !c.rules.HasEPGOffsets() {
+		return nil
+	}
+
+	offsets, err := c.channelEPGOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	shiftEPGListings(listings, offsets)
+
+	return nil
+}
+
+// shiftEPGListings shifts the EPG listings of the provider by the offset of their channel.
+func shiftEPGListings(listings []xtream.EPGInfo, offsets map[string]time.Duration) {
+	for i := range listings {
+		l := &listings[i]
+
+		offset := offsets[l.ChannelID]
+		if offset == 0 {
+			continue
+		}
+
+		l.StartTimestamp.Time = l.StartTimestamp.Add(offset)
+		l.StopTimestamp.Time = l.StopTimestamp.Add(offset)
+		l.Start = shiftEPGTime(l.Start, offset)
+		l.End = shiftEPGTime(l.End, offset)
+	}
+}
+
+// shiftEPGTime shifts a listing time, it is left as is if invalid.
+func shiftEPGTime(value string, offset time.Duration) string {
+	t, err := time.Parse(epgTimeLayout, value)
+	if err != nil {
+		return value
+	}
+
+	return t.Add(offset).Format(epgTimeLayout)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+	xtream "github.com/incmve/iptv-proxy/pkg/xtream-codes-fixed"
+)
+
+func loadTestRules(t *testing.T, dir, content string) *rules.Ruleset {
+	t.Helper()
+
+	path := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rules.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs
+}
+
+func TestEPGOffsets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+#EXTINF:-1 tvg-id="two" group-title="Sports",Channel Two
+http://example.com/two.ts
+`)
+
+	start := time.Now().Add(time.Hour).Truncate(time.Hour).UTC()
+	programme := func(channel string) string {
+		return fmt.Sprintf(`<programme channel="%s" start="%s" stop="%s"><title>%s</title></programme>`,
+			channel, start.Format(xmltv.TimeLayout), start.Add(time.Hour).Format(xmltv.TimeLayout), channel)
+	}
+	guidePath := filepath.Join(dir, "guide.xml")
+	if err := ioutil.WriteFile(guidePath, []byte(`<tv>`+programme("one")+programme("two")+`</tv>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.XMLTVURL = guidePath
+	serverConfig.XtreamEmulation = true
+	serverConfig.rules = loadTestRules(t, dir, `
+rules:
+  - group: "^News$"
+    epg-offset: "-30m"
+`)
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xmltv.php?username=test&password=test", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the guide to be served, got status %d", w.Code)
+	}
+	guide, err := xmltv.Parse(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one := guide.ChannelProgrammes("one"); len(one) != 1 || !one[0].Start.Equal(start.Add(-30*time.Minute)) {
+		t.Errorf("Expected the News programme to be shifted, got %+v", one)
+	}
+	if two := guide.ChannelProgrammes("two"); len(two) != 1 || !two[0].Start.Equal(start) {
+		t.Errorf("Expected the Sports programme to be left as is, got %+v", two)
+	}
+
+	_, _, streamIDs := serverConfig.tracks.snapshot()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/player_api.php?username=test&password=test&action=get_simple_data_table&stream_id="+strconv.Itoa(streamIDs[0]), nil))
+	var epg emulatedEPG
+	if err := json.Unmarshal(w.Body.Bytes(), &epg); err != nil {
+		t.Fatalf("Invalid EPG %q: %v", w.Body.String(), err)
+	}
+	if len(epg.Listings) != 1 || epg.Listings[0].StartTimestamp != strconv.FormatInt(start.Add(-30*time.Minute).Unix(), 10) {
+		t.Errorf("Expected the emulated EPG to be shifted, got %+v", epg.Listings)
+	}
+}
+
+func TestXtreamEPGOffsets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	panel := newFakeXtreamPanel(t)
+	defer panel.Close()
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			XtreamBaseURL:  panel.URL,
+			XtreamUser:     "user",
+			XtreamPassword: "pass",
+		},
+		rules: loadTestRules(t, dir, `
+rules:
+  - group: "News"
+    epg-offset: "2h"
+`),
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php", nil)
+
+	var listings []xtream.EPGInfo
+	err = json.Unmarshal([]byte(`[
+		{"channel_id":"one","start":"2026-01-01 12:00:00","end":"2026-01-01 13:00:00","start_timestamp":"1767268800","stop_timestamp":"1767272400"},
+		{"channel_id":"other","start":"2026-01-01 12:00:00","end":"2026-01-01 13:00:00","start_timestamp":"1767268800","stop_timestamp":"1767272400"}
+	]`), &listings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.shiftEPGResponse(ctx, listings); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := listings[0]; l.Start != "2026-01-01 14:00:00" || l.End != "2026-01-01 15:00:00" || l.StartTimestamp.Unix() != 1767268800+7200 || l.StopTimestamp.Unix() != 1767272400+7200 {
+		t.Errorf("Expected the listing of the News channel to be shifted, got %+v", l)
+	}
+	if l := listings[1]; l.Start != "2026-01-01 12:00:00" || l.StartTimestamp.Unix() != 1767268800 {
+		t.Errorf("Expected the listing of an unknown channel to be left as is, got %+v", l)
+	}
+
+	body, err := json.Marshal(listings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(body, &raw) // nolint: errcheck
+	if raw["start_timestamp"] != strconv.Itoa(1767268800+7200) {
+		t.Errorf("Expected the quoted timestamp to be kept quoted, got %v", raw["start_timestamp"])
+	}
+}
@@ -20,6 +20,8 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,17 +29,82 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/jamesnetherton/m3u"
 )
 
 func (c *Config) getM3U(ctx *gin.Context) {
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(c.proxyfiedM3UPath)
+	ctx.File(c.accountM3UPath(accountFrom(ctx)))
+}
+
+func (c *Config) m3uTrack(ctx *gin.Context) {
+	track, ok := c.tracks.lookup(ctx.Param("track"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.serveTrack(ctx, track)
+}
+
+// m3uTimeshift plays a playlist track from its recording, minutes back from now or as far back as
+// it is recorded. A track not recorded is played live.
+func (c *Config) m3uTimeshift(ctx *gin.Context) {
+	track, ok := c.tracks.lookup(ctx.Param("track"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	minutes, err := strconv.Atoi(ctx.Param("minutes"))
+	if err != nil || minutes < 0 {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	rpURL, err := url.Parse(track.URI)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	recording := c.timeshift.lookup(rpURL.String())
+	if recording == nil || !accountFrom(ctx).AllowGroup(rules.Tag(*track, "group-title")) {
+		c.serveTrack(ctx, track)
+		return
+	}
+
+	c.streamTimeshift(ctx, rpURL, recording, time.Now().Add(-time.Duration(minutes)*time.Minute))
+}
+
+// serveTrack proxies the stream of a playlist track for the authenticated account.
+func (c *Config) serveTrack(ctx *gin.Context, track *m3u.Track) {
+	if !accountFrom(ctx).AllowGroup(rules.Tag(*track, "group-title")) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	trackConfig := &Config{
+		ProxyConfig: c.ProxyConfig,
+		track:       track,
+		users:       c.users,
+		timeshift:   c.timeshift,
+	}
+
+	if strings.HasSuffix(track.URI, ".m3u8") {
+		trackConfig.m3u8ReverseProxy(ctx)
+		return
+	}
+
+	trackConfig.reverseProxy(ctx)
 }
 
 func (c *Config) reverseProxy(ctx *gin.Context) {
@@ -47,7 +114,7 @@ func (c *Config) reverseProxy(ctx *gin.Context) {
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	c.streamLive(ctx, rpURL)
 }
 
 func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
@@ -63,8 +130,23 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 }
 
 func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
+	c.proxyStream(ctx, oriURL, c.shouldUseBuffering(oriURL))
+}
+
+// streamLive proxies a live stream, always buffered while timeshift is enabled so it is recorded.
+func (c *Config) streamLive(ctx *gin.Context, oriURL *url.URL) {
+	c.proxyStream(ctx, oriURL, c.shouldUseBuffering(oriURL) || c.timeshift != nil)
+}
+
+func (c *Config) proxyStream(ctx *gin.Context, oriURL *url.URL, buffered bool) {
+	release, ok := c.acquireStream(ctx)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Check if buffering is enabled for this stream
-	if c.shouldUseBuffering(oriURL) {
+	if buffered {
 		c.streamWithBuffer(ctx, oriURL)
 		return
 	}
@@ -73,28 +155,118 @@ func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
 	c.streamDirect(ctx, oriURL)
 }
 
+// acquireStream counts a stream of the authenticated user, the returned function ends it.
+// The request is aborted if the user reached its maximum connections.
+func (c *Config) acquireStream(ctx *gin.Context) (func(), bool) {
+	account := accountFrom(ctx)
+	if account != nil {
+		if !c.users.acquire(account) {
+			log.Printf("[iptv-proxy] %v | %s | user %q reached its maximum connections\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), account.Username)
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	stopped := GetMetrics().StreamStarted()
+	return func() {
+		stopped()
+		if account != nil {
+			c.users.release(account)
+		}
+	}, true
+}
+
+// streamTimeshift plays the recording of a live stream from start, the channel being kept
+// buffered, hence recorded, while it is played.
+func (c *Config) streamTimeshift(ctx *gin.Context, oriURL *url.URL, recording *timeshiftChannel, start time.Time) {
+	release, ok := c.acquireStream(ctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	hold, err := GetBufferManager().HoldBuffer(oriURL.String(), ctx.Request.Header)
+	if err != nil {
+		log.Printf("[stream] Timeshift of %s played without recording: %v", oriURL.String(), err)
+	} else {
+		defer hold.Close()
+	}
+
+	reader := recording.newReader(ctx.Request.Context(), start)
+	defer reader.Close()
+
+	ctx.Header("Content-Type", "video/mp2t")
+	ctx.Header("Cache-Control", "no-cache")
+
+	log.Printf("[stream] Starting timeshift of %s %v back", oriURL.String(), time.Since(start).Round(time.Second))
+
+	buf := make([]byte, DefaultChunkSize)
+	ctx.Stream(func(w io.Writer) bool {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			countingWriter{w}.Write(buf[:n]) // nolint: errcheck
+		}
+		return err == nil
+	})
+}
+
 func (c *Config) streamDirect(ctx *gin.Context, oriURL *url.URL) {
 	client := &http.Client{}
 
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
+	reqCtx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+
+	accountant := GetConnectionAccountant()
+	lease, err := accountant.Acquire(oriURL.String(), cancel)
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		log.Printf("[stream] %s: %v", oriURL.String(), err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
 		return
 	}
+	defer func() { accountant.Release(lease) }()
+
+	var resp *http.Response
+	for {
+		req, err := http.NewRequestWithContext(reqCtx, "GET", lease.URL, nil)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+		mergeHttpHeader(req.Header, ctx.Request.Header)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+		start := time.Now()
+		resp, err = client.Do(req)
+		if err != nil {
+			GetMetrics().UpstreamError(0)
+		} else {
+			GetMetrics().ObserveConnect(time.Since(start))
+			if resp.StatusCode >= http.StatusBadRequest {
+				GetMetrics().UpstreamError(resp.StatusCode)
+			}
+		}
+		if err == nil && !failoverStatus(resp.StatusCode) {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("upstream returned status %d", resp.StatusCode)
+		}
+		log.Printf("[stream] %s: %v", oriURL.String(), err)
+
+		next, failoverErr := accountant.Failover(lease)
+		if failoverErr != nil {
+			ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+			return
+		}
+		lease = next
 	}
 	defer resp.Body.Close()
 
 	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
 	ctx.Status(resp.StatusCode)
 	ctx.Stream(func(w io.Writer) bool {
-		io.Copy(w, resp.Body) // nolint: errcheck
+		io.Copy(countingWriter{w}, countingReader{resp.Body}) // nolint: errcheck
 		return false
 	})
 }
@@ -102,6 +274,11 @@ func (c *Config) streamDirect(ctx *gin.Context, oriURL *url.URL) {
 func (c *Config) streamWithBuffer(ctx *gin.Context, oriURL *url.URL) {
 	// Create buffered stream writer
 	bufferedWriter, err := NewBufferedStreamWriter(oriURL.String(), ctx.Request.Header)
+	if err == ErrMaxConnections {
+		log.Printf("[stream] %s: %v", oriURL.String(), err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		log.Printf("[stream] Failed to create buffered writer for %s: %v", oriURL.String(), err)
 		// Fall back to direct streaming
@@ -110,25 +287,19 @@ func (c *Config) streamWithBuffer(ctx *gin.Context, oriURL *url.URL) {
 	}
 	defer bufferedWriter.Close()
 
-	// Pre-buffer data before starting playback
+	// Pre-buffer data before starting playback, a viewer joining a warm buffer starts at once
 	preloadDuration := time.Duration(c.ProxyConfig.BufferPreload) * time.Second
-	if preloadDuration > 0 {
-		log.Printf("[stream] Pre-buffering %v seconds for %s", preloadDuration, oriURL.String())
-		
-		// Wait for buffer to accumulate data
-		startTime := time.Now()
-		for time.Since(startTime) < preloadDuration {
-			// Check if buffer has data or if we should timeout
-			select {
-			case <-ctx.Done():
-				log.Printf("[stream] Client disconnected during pre-buffering")
-				return
-			default:
-				time.Sleep(100 * time.Millisecond) // Check every 100ms
-			}
+	start := time.Now()
+	if err := bufferedWriter.reader.buffer.waitPreload(ctx.Request.Context(), preloadDuration); err != nil {
+		if ctx.Request.Context().Err() != nil {
+			log.Printf("[stream] Client disconnected during pre-buffering")
+			return
 		}
-		log.Printf("[stream] Pre-buffering complete, starting playback")
+		log.Printf("[stream] Pre-buffering of %s failed: %v", oriURL.String(), err)
+		ctx.AbortWithStatus(preloadErrorStatus(err))
+		return
 	}
+	log.Printf("[stream] Pre-buffered %s in %v, starting playback", oriURL.String(), time.Since(start).Round(time.Millisecond))
 
 	// Set appropriate headers
 	ctx.Header("Content-Type", "video/mp2t") // Default to MPEG-TS for IPTV
@@ -138,8 +309,8 @@ func (c *Config) streamWithBuffer(ctx *gin.Context, oriURL *url.URL) {
 	log.Printf("[stream] Starting buffered stream for %s", oriURL.String())
 
 	// Stream buffered data to client
+	buf := make([]byte, DefaultChunkSize)
 	ctx.Stream(func(w io.Writer) bool {
-		buf := make([]byte, DefaultChunkSize)
 		n, err := bufferedWriter.Read(buf)
 		if n > 0 {
 			w.Write(buf[:n]) // nolint: errcheck
@@ -150,10 +321,27 @@ func (c *Config) streamWithBuffer(ctx *gin.Context, oriURL *url.URL) {
 			}
 			return false
 		}
+		if n == 0 {
+			// Nothing to send yet
+			bufferedWriter.reader.wait(ctx.Request.Context())
+		}
 		return true
 	})
 }
 
+// preloadErrorStatus returns the status answered to a viewer of a stream which failed to pre-buffer:
+// the error status of the source, 504 if it sent nothing, 502 otherwise.
+func preloadErrorStatus(err error) int {
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.status >= http.StatusBadRequest:
+		return statusErr.status
+	case errors.Is(err, errPreloadTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 func (c *Config) shouldUseBuffering(oriURL *url.URL) bool {
 	// Check if buffering is globally enabled
 	if !c.ProxyConfig.BufferEnabled {
@@ -192,6 +380,17 @@ func (c *Config) xtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	c.stream(ctx, oriURL)
 }
 
+// xtreamLiveStream proxies an xtream live channel, recorded while timeshift is enabled.
+func (c *Config) xtreamLiveStream(ctx *gin.Context, oriURL *url.URL) {
+	id := ctx.Param("id")
+	if strings.HasSuffix(id, ".m3u8") {
+		c.hlsXtreamStream(ctx, oriURL)
+		return
+	}
+
+	c.streamLive(ctx, oriURL)
+}
+
 type values []string
 
 func (vs values) contains(s string) bool {
@@ -227,9 +426,23 @@ func (c *Config) authenticate(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
-	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
+
+	c.authenticateAccount(ctx, authReq.Username, authReq.Password)
+}
+
+// pathAuthenticate handle the credentials of the url path e.g: /live/:username/:password/:id
+func (c *Config) pathAuthenticate(ctx *gin.Context) {
+	c.authenticateAccount(ctx, ctx.Param("username"), ctx.Param("password"))
+}
+
+func (c *Config) authenticateAccount(ctx *gin.Context, username, password string) {
+	account, ok := c.users.authenticate(username, password)
+	if !ok {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
 	}
+
+	ctx.Set(accountKey, account)
 }
 
 func (c *Config) appAuthenticate(ctx *gin.Context) {
@@ -249,9 +462,7 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		return
 	}
 	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
-	}
+	c.authenticateAccount(ctx, q["username"][0], q["password"][0])
 
 	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(contents))
 }
@@ -259,5 +470,12 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 func (c *Config) bufferStats(ctx *gin.Context) {
 	manager := GetBufferManager()
 	stats := manager.GetStats()
+	stats["upstream_connections"] = GetConnectionAccountant().Stats()
 	ctx.JSON(http.StatusOK, stats)
 }
+
+func (c *Config) metrics(ctx *gin.Context) {
+	ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ctx.Status(http.StatusOK)
+	GetMetrics().WriteTo(ctx.Writer) // nolint: errcheck
+}
@@ -0,0 +1,294 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/incmve/iptv-proxy/pkg/ssdp"
+	"github.com/jamesnetherton/m3u"
+)
+
+// defaultTunerCount is advertised when the provider connections are unlimited
+const defaultTunerCount = 2
+
+type hdhrDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+type hdhrLineupItem struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrDevice struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+		UDN          string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+// hdhrRoutes registers the HDHomeRun tuner endpoints, used by Plex, Jellyfin and Emby.
+// These clients can't authenticate, the lineup is the playlist of the HDHomeRun user.
+// Only the device description is served for SSDP discovery without the tuner emulation.
+func (c *Config) hdhrRoutes(r *gin.RouterGroup) {
+	r.GET("/device.xml", c.hdhrDeviceXML)
+	if !c.HDHomeRun {
+		return
+	}
+
+	r.GET("/discover.json", c.hdhrDiscover)
+	r.GET("/lineup.json", c.hdhrLineup)
+	r.GET("/lineup_status.json", c.hdhrLineupStatus)
+}
+
+// baseURL returns the advertised url of the proxy
+func (c *Config) baseURL() string {
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+
+	customEnd := strings.Trim(c.CustomEndpoint, "/")
+	if customEnd != "" {
+		customEnd = fmt.Sprintf("/%s", customEnd)
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s", protocol, c.HostConfig.Hostname, c.AdvertisedPort, customEnd)
+}
+
+// hdhrDeviceHash returns a hash identifying the proxy on the network
+func (c *Config) hdhrDeviceHash() string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d", c.HostConfig.Hostname, c.AdvertisedPort)))
+	return hex.EncodeToString(sum[:])
+}
+
+// hdhrDeviceID returns the HDHomeRun device id of the proxy
+func (c *Config) hdhrDeviceID() string {
+	return strings.ToUpper(c.hdhrDeviceHash()[:8])
+}
+
+// hdhrUDN returns the UPnP unique device name of the proxy
+func (c *Config) hdhrUDN() string {
+	h := c.hdhrDeviceHash()
+	return fmt.Sprintf("uuid:%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// hdhrFriendlyName returns the name of the tuner
+func (c *Config) hdhrFriendlyName() string {
+	if c.HDHomeRunName != "" {
+		return c.HDHomeRunName
+	}
+	return "iptv-proxy"
+}
+
+// hdhrAccount returns the config for the HDHomeRun user, the tuner serves no other user's playlist.
+func (c *Config) hdhrAccount() (*Config, error) {
+	tmp := *c
+
+	if c.HDHomeRunUser == "" {
+		return nil, fmt.Errorf("no HDHomeRun user")
+	}
+
+	account, ok := c.users.get(c.HDHomeRunUser)
+	if !ok {
+		return nil, fmt.Errorf("unknown HDHomeRun user %q", c.HDHomeRunUser)
+	}
+	tmp.account = account
+
+	return &tmp, nil
+}
+
+// hdhrTunerCount returns the number of concurrent streams allowed by the provider
+func (c *Config) hdhrTunerCount() int {
+	count := GetConnectionAccountant().Limit()
+	if c.account != nil && c.account.MaxConnections > 0 && (count == 0 || c.account.MaxConnections < count) {
+		count = c.account.MaxConnections
+	}
+	if count == 0 {
+		count = defaultTunerCount
+	}
+
+	return count
+}
+
+// hdhrTracks returns the proxyfied tracks of the HDHomeRun user
+func (c *Config) hdhrTracks(ctx *gin.Context) ([]m3u.Track, error) {
+	path := c.accountM3UPath(c.account)
+	// Without m3u source the lineup is built from the xtream API
+	if c.xtreamAuto() || (c.XtreamBaseURL != "" && len(c.sources.sources) == 0) {
+		var err error
+		if path, err = c.xtreamApiGetPath(ctx, "ts", []string{xtreamLive}); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	playlist, err := m3u.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return playlist.Tracks, nil
+}
+
+func (c *Config) hdhrDiscover(ctx *gin.Context) {
+	c, err := c.hdhrAccount()
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	baseURL := c.baseURL()
+	ctx.JSON(http.StatusOK, hdhrDiscover{
+		FriendlyName:    c.hdhrFriendlyName(),
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20150826",
+		DeviceID:        c.hdhrDeviceID(),
+		DeviceAuth:      "iptv-proxy",
+		BaseURL:         baseURL,
+		LineupURL:       baseURL + "/lineup.json",
+		TunerCount:      c.hdhrTunerCount(),
+	})
+}
+
+func (c *Config) hdhrLineup(ctx *gin.Context) {
+	c, err := c.hdhrAccount()
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	tracks, err := c.hdhrTracks(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	lineup := make([]hdhrLineupItem, 0, len(tracks))
+	for i, track := range tracks {
+		number := rules.Tag(track, "tvg-chno")
+		if number == "" {
+			number = strconv.Itoa(i + 1)
+		}
+
+		lineup = append(lineup, hdhrLineupItem{
+			GuideNumber: number,
+			GuideName:   track.Name,
+			URL:         track.URI,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, lineup)
+}
+
+func (c *Config) hdhrLineupStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, hdhrLineupStatus{
+		ScanInProgress: 0,
+		ScanPossible:   1,
+		Source:         "Cable",
+		SourceList:     []string{"Cable"},
+	})
+}
+
+// startSSDP announces the proxy on the LAN until the server shuts down
+func (c *Config) startSSDP() error {
+	responder, err := ssdp.Listen(ssdp.DefaultAddr, ssdp.Device{
+		UDN:      c.hdhrUDN(),
+		Location: c.baseURL() + "/device.xml",
+		Types:    []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+		Server:   "iptv-proxy UPnP/1.0",
+	})
+	if err != nil {
+		return fmt.Errorf("unable to start SSDP responder: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.done
+		cancel()
+	}()
+	go func() {
+		if err := responder.Serve(ctx); err != nil {
+			log.Printf("[iptv-proxy] WARNING: SSDP responder stopped: %v", err)
+		}
+	}()
+
+	log.Printf("[iptv-proxy] Announcing %s on SSDP", c.baseURL())
+	return nil
+}
+
+func (c *Config) hdhrDeviceXML(ctx *gin.Context) {
+	device := hdhrDevice{URLBase: c.baseURL()}
+	device.SpecVersion.Major = 1
+	device.SpecVersion.Minor = 0
+	device.Device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	device.Device.FriendlyName = c.hdhrFriendlyName()
+	device.Device.Manufacturer = "Silicondust"
+	device.Device.ModelName = "HDTC-2US"
+	device.Device.ModelNumber = "HDTC-2US"
+	device.Device.SerialNumber = c.hdhrDeviceID()
+	device.Device.UDN = c.hdhrUDN()
+
+	ctx.XML(http.StatusOK, device)
+}
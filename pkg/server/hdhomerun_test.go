@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+func TestHDHomeRun(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" tvg-chno="101" group-title="News",Channel One
+http://example.com/one.ts
+#EXTINF:-1 tvg-id="two" group-title="Sports",Channel Two
+http://example.com/two.ts
+`)
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.HDHomeRun = true
+	serverConfig.HDHomeRunUser = "test"
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be served, got status %d", path, w.Code)
+		}
+		return w
+	}
+
+	var discover hdhrDiscover
+	if err := json.Unmarshal(get("/discover.json").Body.Bytes(), &discover); err != nil {
+		t.Fatal(err)
+	}
+	if discover.BaseURL != "http://localhost:8080" || discover.LineupURL != "http://localhost:8080/lineup.json" {
+		t.Errorf("Unexpected urls %q %q", discover.BaseURL, discover.LineupURL)
+	}
+	if len(discover.DeviceID) != 8 || discover.TunerCount != defaultTunerCount {
+		t.Errorf("Unexpected device %q with %d tuners", discover.DeviceID, discover.TunerCount)
+	}
+
+	var lineup []hdhrLineupItem
+	if err := json.Unmarshal(get("/lineup.json").Body.Bytes(), &lineup); err != nil {
+		t.Fatal(err)
+	}
+	ids := trackIDs(serverConfig.playlist.Tracks)
+	if len(lineup) != 2 {
+		t.Fatalf("Expected 2 channels, got %+v", lineup)
+	}
+	if lineup[0].GuideNumber != "101" || lineup[0].GuideName != "Channel One" ||
+		lineup[0].URL != "http://localhost:8080/"+serverConfig.endpointAntiColision+"/test/test/"+ids[0]+"/one.ts" {
+		t.Errorf("Unexpected first channel %+v", lineup[0])
+	}
+	if lineup[1].GuideNumber != "2" {
+		t.Errorf("Expected the position as guide number, got %q", lineup[1].GuideNumber)
+	}
+
+	if body := get("/lineup_status.json").Body.String(); !strings.Contains(body, `"ScanPossible":1`) {
+		t.Errorf("Unexpected lineup status %s", body)
+	}
+	if body := get("/device.xml").Body.String(); !strings.Contains(body, "<UDN>"+serverConfig.hdhrUDN()+"</UDN>") {
+		t.Errorf("Unexpected device description %s", body)
+	}
+}
+
+func TestHDHomeRunXtream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	panel := newFakeXtreamPanel(t)
+	defer panel.Close()
+
+	// No m3u source, the lineup comes from the xtream API
+	proxyConfig := config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname: "localhost",
+			Port:     8080,
+		},
+		RemoteURL:      &url.URL{},
+		XtreamBaseURL:  panel.URL,
+		XtreamUser:     "user",
+		XtreamPassword: "pass",
+		User:           "test",
+		Password:       "test",
+		AdvertisedPort: 8080,
+		HDHomeRun:      true,
+	}
+
+	// The tuner never exposes a user picked implicitly
+	if _, err := NewServer(&proxyConfig); err == nil {
+		t.Fatal("Expected the tuner to require --hdhr-user")
+	}
+
+	proxyConfig.HDHomeRunUser = "test"
+	serverConfig, err := NewServer(&proxyConfig)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer clearXtreamM3uCache()
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/lineup.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the lineup, got status %d", w.Code)
+	}
+
+	var lineup []hdhrLineupItem
+	if err := json.Unmarshal(w.Body.Bytes(), &lineup); err != nil {
+		t.Fatal(err)
+	}
+	if len(lineup) != 1 || lineup[0].GuideName != "Channel One" || !strings.HasSuffix(lineup[0].URL, "/live/test/test/11.ts") {
+		t.Errorf("Expected the live channel of the xtream API, got %+v", lineup)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+// maxImageSize is the largest image the proxy downloads.
+const maxImageSize = 10 << 20
+
+// imageProxy serves the provider images from a cache on disk, so the clients never
+// see the provider host and the images are still served when it is down.
+type imageProxy struct {
+	sync.Mutex
+	secret   []byte
+	dir      string
+	ttl      time.Duration
+	client   *http.Client
+	inflight map[string]*imageFetch
+}
+
+// imageFetch is a download shared by the concurrent requests of the same image.
+type imageFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newImageProxy(proxyConfig *config.ProxyConfig) (*imageProxy, error) {
+	dir := filepath.Join(xmltvCacheDir(), "iptv-proxy-images")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create the image cache folder: %v", err)
+	}
+
+	secret := proxyConfig.ImageProxySecret
+	if secret == "" {
+		// Stable across restarts, so the clients keep their cached images
+		secret = strings.Join([]string{
+			proxyConfig.User.String(), proxyConfig.Password.String(),
+			proxyConfig.XtreamUser.String(), proxyConfig.XtreamPassword.String(), proxyConfig.XtreamBaseURL,
+		}, "\x00")
+	}
+	h := sha256.Sum256([]byte(secret))
+
+	return &imageProxy{
+		secret:   h[:],
+		dir:      dir,
+		ttl:      proxyConfig.ImageCacheTTL,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		inflight: make(map[string]*imageFetch),
+	}, nil
+}
+
+// sign returns the signature of the image url, the proxy only serves the urls it wrote.
+func (p *imageProxy) sign(rawURL string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(rawURL)) // nolint: errcheck
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// imageURL returns the proxyfied url of an image, the url is left as is if the image proxy is disabled.
+func (c *Config) imageURL(rawURL string) string {
+	if c.images == nil || (!strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://")) {
+		return rawURL
+	}
+
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+
+	customEnd := strings.Trim(c.CustomEndpoint, "/")
+	if customEnd != "" {
+		customEnd = fmt.Sprintf("/%s", customEnd)
+	}
+
+	// The extension is kept for the clients guessing the image type from the url
+	name := base64.RawURLEncoding.EncodeToString([]byte(rawURL))
+	if u, err := url.Parse(rawURL); err == nil && len(path.Ext(u.Path)) <= 5 {
+		name += path.Ext(u.Path)
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s/images/%s/%s", protocol, c.HostConfig.Hostname, c.AdvertisedPort, customEnd, c.images.sign(rawURL), name)
+}
+
+// serveImage serves /images/:sig/:name, name being the base64 encoded url of the image.
+func (c *Config) serveImage(ctx *gin.Context) {
+	name := ctx.Param("name")
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+
+	rawURL, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || !hmac.Equal([]byte(ctx.Param("sig")), []byte(c.images.sign(string(rawURL)))) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.images.serve(ctx, string(rawURL))
+}
+
+// serve writes the cached image, it is downloaded first if missing or expired.
+// An expired image is still served if the download fails.
+func (p *imageProxy) serve(ctx *gin.Context, rawURL string) {
+	h := sha1.Sum([]byte(rawURL))
+	cachePath := filepath.Join(p.dir, hex.EncodeToString(h[:]))
+
+	info, err := os.Stat(cachePath)
+	if err != nil || time.Since(info.ModTime()) >= p.ttl {
+		if fetchErr := p.fetch(rawURL, cachePath); fetchErr != nil {
+			if err != nil {
+				ctx.AbortWithError(http.StatusBadGateway, fetchErr) // nolint: errcheck
+				return
+			}
+			log.Printf("[iptv-proxy] WARNING: serving the expired image %s: %v", rawURL, fetchErr)
+		}
+	}
+
+	f, err := os.Open(cachePath)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	defer f.Close()
+
+	info, err = f.Stat()
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(p.ttl.Seconds())))
+	http.ServeContent(ctx.Writer, ctx.Request, "", info.ModTime(), f)
+}
+
+// fetch downloads the image, the concurrent requests of the same image wait for the same download.
+func (p *imageProxy) fetch(rawURL, cachePath string) error {
+	p.Lock()
+	if f, ok := p.inflight[cachePath]; ok {
+		p.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &imageFetch{done: make(chan struct{})}
+	p.inflight[cachePath] = f
+	p.Unlock()
+
+	f.err = p.download(rawURL, cachePath)
+
+	p.Lock()
+	delete(p.inflight, cachePath)
+	p.Unlock()
+	close(f.done)
+
+	return f.err
+}
+
+// download writes the image into a temporary file moved over the cached one.
+func (p *imageProxy) download(rawURL, cachePath string) error {
+	resp, err := p.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("image upstream returned status %d", resp.StatusCode)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/") {
+		return fmt.Errorf("image upstream returned %s", resp.Header.Get("Content-Type"))
+	}
+
+	tmp, err := ioutil.TempFile(p.dir, "image-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, maxImageSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > maxImageSize {
+		err = fmt.Errorf("image larger than %d bytes", maxImageSize)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name()) // nolint: errcheck
+	}
+
+	return err
+}
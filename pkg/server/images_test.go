@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/jamesnetherton/m3u"
+)
+
+func TestImageProxy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(folder string) { config.CacheFolder = folder }(config.CacheFolder)
+	config.CacheFolder = dir
+
+	png := []byte("\x89PNG\r\n\x1a\n fake logo")
+	var hits int32
+	var down int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(png) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	proxyConfig := &config.ProxyConfig{
+		HostConfig:     &config.HostConfiguration{Hostname: "localhost", Port: 8080},
+		AdvertisedPort: 8080,
+		User:           "test",
+		Password:       "test",
+		ImageProxy:     true,
+		ImageCacheTTL:  time.Hour,
+	}
+	images, err := newImageProxy(proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ProxyConfig: proxyConfig, images: images}
+
+	router := gin.New()
+	c.routes(router.Group("/"))
+
+	get := func(rawURL string) *httptest.ResponseRecorder {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		return w
+	}
+
+	logo := upstream.URL + "/logos/one.png?size=big"
+	proxied := c.imageURL(logo)
+	if !strings.HasPrefix(proxied, "http://localhost:8080/images/") || !strings.HasSuffix(proxied, ".png") || strings.Contains(proxied, upstream.URL) {
+		t.Fatalf("Unexpected proxyfied image url %q", proxied)
+	}
+	if c.imageURL("") != "" || c.imageURL("logo.png") != "logo.png" {
+		t.Error("Expected the empty and relative urls to be left as is")
+	}
+
+	c.playlist = &m3u.Playlist{Tracks: []m3u.Track{{Name: "One", Length: -1, URI: "http://example.com/one.ts", Tags: []m3u.Tag{{Name: "tvg-logo", Value: logo}}}}}
+	playlistFile, err := ioutil.TempFile(dir, "playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer playlistFile.Close()
+	if err := c.marshallInto(playlistFile, false); err != nil {
+		t.Fatal(err)
+	}
+	if playlist, _ := ioutil.ReadFile(playlistFile.Name()); !strings.Contains(string(playlist), `tvg-logo="`+proxied+`"`) {
+		t.Errorf("Expected the logo of the playlist to be proxyfied, got %s", playlist)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get(proxied)
+		if w.Code != http.StatusOK || w.Body.String() != string(png) || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("Expected the image, got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("Expected the image to be downloaded once, got %d downloads", hits)
+	}
+
+	// Not signed by the proxy
+	if w := get(strings.Replace(proxied, "/images/", "/images/0", 1)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an invalid signature to be rejected, got %d", w.Code)
+	}
+
+	// The provider image host is down
+	atomic.StoreInt32(&down, 1)
+	images.ttl = 0
+	if w := get(proxied); w.Code != http.StatusOK || w.Body.String() != string(png) {
+		t.Errorf("Expected the expired image to be served, got %d", w.Code)
+	}
+	if w := get(c.imageURL(upstream.URL + "/logos/two.png")); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a missing image to fail, got %d", w.Code)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/incmve/iptv-proxy/pkg/config"
 )
 
@@ -118,4 +120,73 @@ func TestBufferManagerLifecycle(t *testing.T) {
 		// Wait a bit for cleanup
 		time.Sleep(100 * time.Millisecond)
 	})
-}
\ No newline at end of file
+}
+func TestStreamPreload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	manager := GetBufferManager()
+	manager.SetBufferDuration(50 * time.Millisecond)
+	defer manager.SetBufferDuration(DefaultBufferDuration)
+
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		for {
+			w.Write([]byte("live data")) // nolint: errcheck
+			w.(http.Flusher).Flush()
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	c := &Config{ProxyConfig: &config.ProxyConfig{BufferEnabled: true, BufferPreload: 1}}
+	router := gin.New()
+	router.GET("/*path", func(ctx *gin.Context) {
+		oriURL, _ := url.Parse(upstream.URL + ctx.Param("path"))
+		c.streamWithBuffer(ctx, oriURL)
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	// play returns the status and the time to the first byte of the stream
+	play := func(path string) (int, time.Duration) {
+		start := time.Now()
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			buf := make([]byte, len("live data"))
+			if n, err := resp.Body.Read(buf); err != nil || !strings.HasPrefix("live data", string(buf[:n])) {
+				t.Errorf("Expected the stream data, got %q: %v", buf[:n], err)
+			}
+		}
+		return resp.StatusCode, time.Since(start)
+	}
+
+	if status, elapsed := play("/missing"); status != http.StatusNotFound || elapsed > time.Second {
+		t.Errorf("Expected the upstream 404 at once, got %d after %v", status, elapsed)
+	}
+
+	status, elapsed := play("/live")
+	if status != http.StatusOK || elapsed < time.Second {
+		t.Errorf("Expected the stream after the 1s preload, got %d after %v", status, elapsed)
+	}
+
+	// The buffer is kept a while after its viewer left
+	if status, elapsed := play("/live"); status != http.StatusOK || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected a viewer joining the warm buffer to start at once, got %d after %v", status, elapsed)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectLatencyBuckets are the upper bounds in seconds of the upstream connect latency histogram
+var connectLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the proxy counters exposed in the Prometheus text format
+type Metrics struct {
+	mutex          sync.Mutex
+	activeStreams  int
+	bytesIn        int64
+	bytesOut       int64
+	latencyCounts  []int64
+	latencySum     float64
+	latencyCount   int64
+	upstreamErrors map[string]int64
+	cacheHits      int64
+	cacheMisses    int64
+	apiActions     map[string]int64
+}
+
+var globalMetrics *Metrics
+var metricsOnce sync.Once
+
+// GetMetrics returns the global metrics instance
+func GetMetrics() *Metrics {
+	metricsOnce.Do(func() {
+		globalMetrics = newMetrics()
+	})
+	return globalMetrics
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		latencyCounts:  make([]int64, len(connectLatencyBuckets)),
+		upstreamErrors: make(map[string]int64),
+		apiActions:     make(map[string]int64),
+	}
+}
+
+// StreamStarted counts a new client stream, the returned function ends it
+func (m *Metrics) StreamStarted() func() {
+	m.mutex.Lock()
+	m.activeStreams++
+	m.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			m.activeStreams--
+			m.mutex.Unlock()
+		})
+	}
+}
+
+// AddBytesIn counts bytes received from the upstream
+func (m *Metrics) AddBytesIn(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.bytesIn += int64(n)
+}
+
+// AddBytesOut counts bytes sent to the clients
+func (m *Metrics) AddBytesOut(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.bytesOut += int64(n)
+}
+
+// ObserveConnect records the time taken to get the upstream response headers
+func (m *Metrics) ObserveConnect(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	seconds := d.Seconds()
+	for i, bound := range connectLatencyBuckets {
+		if seconds <= bound {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+// UpstreamError counts an upstream failure, status is 0 when the connection failed
+func (m *Metrics) UpstreamError(status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	code := "connection"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	m.upstreamErrors[code]++
+}
+
+// CacheLookup counts a hit or a miss of the xtream m3u cache
+func (m *Metrics) CacheLookup(hit bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+// APIAction counts an xtream player API action
+func (m *Metrics) APIAction(action string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.apiActions[action]++
+}
+
+// WriteTo writes all the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	mw := &metricsWriter{w: w}
+
+	m.mutex.Lock()
+	mw.metric("iptv_proxy_active_streams", "gauge", "Client streams being served.", nil, float64(m.activeStreams))
+	mw.metric("iptv_proxy_bytes_in_total", "counter", "Bytes received from the upstream.", nil, float64(m.bytesIn))
+	mw.metric("iptv_proxy_bytes_out_total", "counter", "Bytes sent to the clients.", nil, float64(m.bytesOut))
+
+	mw.header("iptv_proxy_upstream_connect_seconds", "histogram", "Time to get the upstream response headers.")
+	for i, bound := range connectLatencyBuckets {
+		mw.sample("iptv_proxy_upstream_connect_seconds_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(m.latencyCounts[i]))
+	}
+	mw.sample("iptv_proxy_upstream_connect_seconds_bucket", []string{"le", "+Inf"}, float64(m.latencyCount))
+	mw.sample("iptv_proxy_upstream_connect_seconds_sum", nil, m.latencySum)
+	mw.sample("iptv_proxy_upstream_connect_seconds_count", nil, float64(m.latencyCount))
+
+	mw.header("iptv_proxy_upstream_errors_total", "counter", "Upstream failures by status code.")
+	for _, code := range sortedKeys(m.upstreamErrors) {
+		mw.sample("iptv_proxy_upstream_errors_total", []string{"status", code}, float64(m.upstreamErrors[code]))
+	}
+
+	mw.metric("iptv_proxy_xtream_m3u_cache_hits_total", "counter", "Xtream m3u cache hits.", nil, float64(m.cacheHits))
+	mw.metric("iptv_proxy_xtream_m3u_cache_misses_total", "counter", "Xtream m3u cache misses.", nil, float64(m.cacheMisses))
+
+	mw.header("iptv_proxy_xtream_api_actions_total", "counter", "Xtream player API requests by action.")
+	for _, action := range sortedKeys(m.apiActions) {
+		mw.sample("iptv_proxy_xtream_api_actions_total", []string{"action", action}, float64(m.apiActions[action]))
+	}
+	m.mutex.Unlock()
+
+	accountant := GetConnectionAccountant()
+	mw.header("iptv_proxy_upstream_connections", "gauge", "Upstream connections by provider account.")
+	for _, account := range accountant.Stats()["accounts"].([]map[string]interface{}) {
+		mw.sample("iptv_proxy_upstream_connections", []string{"account", account["account"].(string)}, float64(account["active"].(int)))
+	}
+
+	buffers := GetBufferManager().metrics()
+	mw.metric("iptv_proxy_buffers", "gauge", "Active stream buffers.", nil, float64(len(buffers)))
+	mw.header("iptv_proxy_buffer_readers", "gauge", "Clients reading a stream buffer.")
+	for _, b := range buffers {
+		mw.sample("iptv_proxy_buffer_readers", []string{"stream", accountant.Redact(b.url)}, float64(b.readers))
+	}
+	mw.header("iptv_proxy_buffer_bytes_in_total", "counter", "Bytes received from the upstream by stream buffer.")
+	for _, b := range buffers {
+		mw.sample("iptv_proxy_buffer_bytes_in_total", []string{"stream", accountant.Redact(b.url)}, float64(b.bytesIn))
+	}
+	mw.header("iptv_proxy_buffer_bytes_out_total", "counter", "Bytes sent to the clients by stream buffer.")
+	for _, b := range buffers {
+		mw.sample("iptv_proxy_buffer_bytes_out_total", []string{"stream", accountant.Redact(b.url)}, float64(b.bytesOut))
+	}
+	mw.header("iptv_proxy_buffer_memory_bytes", "gauge", "Bytes held in memory by stream buffer.")
+	for _, b := range buffers {
+		mw.sample("iptv_proxy_buffer_memory_bytes", []string{"stream", accountant.Redact(b.url)}, float64(b.memory))
+	}
+
+	return mw.n, mw.err
+}
+
+// metricsWriter writes the Prometheus text format, keeping the first error
+type metricsWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, a ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(mw.w, format, a...)
+	mw.n += int64(n)
+	mw.err = err
+}
+
+func (mw *metricsWriter) header(name, metricType, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a sample, labels are name/value pairs
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	if len(labels) == 0 {
+		mw.printf("%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+		return
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], escapeLabel(labels[i+1])))
+	}
+	mw.printf("%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) metric(name, metricType, help string, labels []string, value float64) {
+	mw.header(name, metricType, help)
+	mw.sample(name, labels, value)
+}
+
+// escapeLabel keeps the label value valid once quoted with %q
+func escapeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingReader counts the bytes read from an upstream
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	GetMetrics().AddBytesIn(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to a client
+type countingWriter struct {
+	io.Writer
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	GetMetrics().AddBytesOut(n)
+	return n, err
+}
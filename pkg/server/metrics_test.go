@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+
+	end := m.StreamStarted()
+	m.StreamStarted()
+	end()
+	end()
+	m.AddBytesIn(100)
+	m.AddBytesOut(40)
+	m.ObserveConnect(200 * time.Millisecond)
+	m.UpstreamError(0)
+	m.UpstreamError(401)
+	m.UpstreamError(401)
+	m.CacheLookup(true)
+	m.CacheLookup(false)
+	m.CacheLookup(false)
+	m.APIAction("get_live_streams")
+
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE iptv_proxy_active_streams gauge",
+		"iptv_proxy_active_streams 1",
+		"iptv_proxy_bytes_in_total 100",
+		"iptv_proxy_bytes_out_total 40",
+		`iptv_proxy_upstream_connect_seconds_bucket{le="0.1"} 0`,
+		`iptv_proxy_upstream_connect_seconds_bucket{le="0.25"} 1`,
+		`iptv_proxy_upstream_connect_seconds_bucket{le="+Inf"} 1`,
+		"iptv_proxy_upstream_connect_seconds_count 1",
+		`iptv_proxy_upstream_errors_total{status="401"} 2`,
+		`iptv_proxy_upstream_errors_total{status="connection"} 1`,
+		"iptv_proxy_xtream_m3u_cache_hits_total 1",
+		"iptv_proxy_xtream_m3u_cache_misses_total 2",
+		`iptv_proxy_xtream_api_actions_total{action="get_live_streams"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, out)
+		}
+	}
+}
+
+func TestMetricsRedactsCredentials(t *testing.T) {
+	ca := newConnectionAccountant()
+	ca.SetAccounts([]UpstreamAccount{{XtreamAccount: xtreamTestAccount}}, false)
+
+	if got := ca.Redact("http://main.tv:8080/live/user1/pass1/42.ts?token=abc"); got != "http://main.tv:8080/live/42.ts" {
+		t.Errorf("Unexpected redacted url %q", got)
+	}
+
+	// The buffer stats list the streams of the accounts without their credentials
+	if _, err := ca.Acquire("http://main.tv:8080/live/user1/pass1/42.ts", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := json.Marshal(ca.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stats), "pass1") || !strings.Contains(string(stats), "http://main.tv:8080/live/42.ts") {
+		t.Errorf("Expected the redacted stream in the stats, got %s", stats)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// tsPacketSize is the size of an MPEG-TS packet
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	patPID       = 0x0000
+	tsNullPID    = 0x1fff
+	// tsProbeSize is the data an MPEG-TS stream is detected on,
+	// less if the source sends nothing more within tsProbeTimeout
+	tsProbeSize    = 3 * tsPacketSize
+	tsProbeTimeout = 500 * time.Millisecond
+)
+
+// Stream types of the video elementary streams in the PMT
+const (
+	streamTypeMPEG1Video = 0x01
+	streamTypeMPEG2Video = 0x02
+	streamTypeMPEG4Video = 0x10
+	streamTypeH264       = 0x1b
+	streamTypeHEVC       = 0x24
+)
+
+// tsPacket is a 188 bytes MPEG-TS packet starting with the sync byte.
+type tsPacket []byte
+
+func (p tsPacket) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+func (p tsPacket) payloadStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p tsPacket) hasAdaptation() bool {
+	return p[3]&0x20 != 0
+}
+
+// randomAccess reports whether the random_access_indicator of the adaptation field is set.
+func (p tsPacket) randomAccess() bool {
+	return p.hasAdaptation() && p[4] > 0 && p[5]&0x40 != 0
+}
+
+func (p tsPacket) payload() []byte {
+	if p[3]&0x10 == 0 {
+		return nil
+	}
+
+	start := 4
+	if p.hasAdaptation() {
+		start += 1 + int(p[4])
+	}
+	if start >= len(p) {
+		return nil
+	}
+
+	return p[start:]
+}
+
+// section returns the PSI section starting in the packet, nil if there is none.
+func (p tsPacket) section() []byte {
+	payload := p.payload()
+	if !p.payloadStart() || len(payload) == 0 {
+		return nil
+	}
+
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+	section := payload[start:]
+
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2]))
+	if end > len(section) {
+		// Sections spanning several packets are not parsed
+		return nil
+	}
+
+	return section[:end]
+}
+
+// tsSync returns the offset of the first packet of data, -1 if data isn't an MPEG-TS stream.
+// A packet is accepted when the next two packets, those in data, start with the sync byte too.
+func tsSync(data []byte) int {
+	for i := 0; i < len(data) && i < tsPacketSize; i++ {
+		if data[i] != tsSyncByte {
+			continue
+		}
+
+		synced := true
+		for next := i + tsPacketSize; next < len(data) && next <= i+2*tsPacketSize; next += tsPacketSize {
+			if data[next] != tsSyncByte {
+				synced = false
+				break
+			}
+		}
+		if synced {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// tsDetect reports whether data is an MPEG-TS stream: three packets in a row start with the sync byte,
+// the first one within the first packet size bytes.
+func tsDetect(data []byte) bool {
+	for i := 0; i < tsPacketSize && i+2*tsPacketSize < len(data); i++ {
+		if data[i] == tsSyncByte && data[i+tsPacketSize] == tsSyncByte && data[i+2*tsPacketSize] == tsSyncByte {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tsIndexer follows the PAT and PMT of an MPEG-TS stream to keep their latest
+// packets and to spot the random access points of the video.
+type tsIndexer struct {
+	pat  []byte
+	pmts map[uint16][]byte
+	// pids of the elementary streams and of the PCR by PMT pid
+	streams map[uint16][]uint16
+
+	// keyPID is the elementary stream the random access points are looked for in,
+	// the video or the first stream of a radio.
+	keyPID    uint16
+	keyType   byte
+	keyIsSet  bool
+	keyAnyPES bool
+}
+
+func newTSIndexer() *tsIndexer {
+	return &tsIndexer{pmts: make(map[uint16][]byte), streams: make(map[uint16][]uint16)}
+}
+
+// inspect records the tables of the packet, it reports whether the packet is a random access point.
+func (x *tsIndexer) inspect(p tsPacket) bool {
+	pid := p.pid()
+
+	if pid == patPID {
+		if section := p.section(); len(section) > 0 && section[0] == 0x00 {
+			x.pat = append(x.pat[:0], p...)
+			x.parsePAT(section)
+		}
+		return false
+	}
+
+	if _, ok := x.pmts[pid]; ok {
+		if section := p.section(); len(section) > 0 && section[0] == 0x02 {
+			x.pmts[pid] = append(x.pmts[pid][:0], p...)
+			x.parsePMT(pid, section)
+		}
+		return false
+	}
+
+	if !x.keyIsSet || pid != x.keyPID {
+		return false
+	}
+	if p.randomAccess() {
+		return true
+	}
+	if !p.payloadStart() {
+		return false
+	}
+
+	return x.keyAnyPES || esRandomAccess(p.payload(), x.keyType)
+}
+
+// parsePAT records the PMT pids of the programs.
+func (x *tsIndexer) parsePAT(section []byte) {
+	if len(section) < 12 {
+		return
+	}
+
+	pids := make(map[uint16]bool)
+	for i := 8; i+4 <= len(section)-4; i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program == 0 {
+			// Network information table
+			continue
+		}
+		pids[uint16(section[i+2]&0x1f)<<8|uint16(section[i+3])] = true
+	}
+
+	for pid := range x.pmts {
+		if !pids[pid] {
+			delete(x.pmts, pid)
+			delete(x.streams, pid)
+		}
+	}
+	for pid := range pids {
+		if _, ok := x.pmts[pid]; !ok {
+			x.pmts[pid] = nil
+		}
+	}
+}
+
+// parsePMT records the streams of the program and picks its video stream, or its first stream if it has no video.
+func (x *tsIndexer) parsePMT(pmtPID uint16, section []byte) {
+	if len(section) < 16 {
+		return
+	}
+
+	streams := make([]uint16, 0)
+	if pcrPID := uint16(section[8]&0x1f)<<8 | uint16(section[9]); pcrPID != tsNullPID {
+		streams = append(streams, pcrPID)
+	}
+
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	first, video := true, false
+	for ; i+5 <= len(section)-4; i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4])) {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		// The PCR is usually carried by the video
+		if len(streams) == 0 || streams[0] != pid {
+			streams = append(streams, pid)
+		}
+
+		switch {
+		case video:
+		case isVideoStreamType(streamType):
+			x.keyPID, x.keyType, x.keyIsSet, x.keyAnyPES = pid, streamType, true, false
+			video = true
+		case first && (!x.keyIsSet || x.keyAnyPES):
+			x.keyPID, x.keyType, x.keyIsSet, x.keyAnyPES = pid, streamType, true, true
+		}
+		first = false
+	}
+
+	x.streams[pmtPID] = streams
+}
+
+// tables returns the latest PAT and PMT packets, a decoder needs them before the first frame.
+func (x *tsIndexer) tables() []byte {
+	if len(x.pat) == 0 {
+		return nil
+	}
+
+	pids := make([]int, 0, len(x.pmts))
+	for pid, pmt := range x.pmts {
+		if len(pmt) > 0 {
+			pids = append(pids, int(pid))
+		}
+	}
+	if len(pids) == 0 {
+		return nil
+	}
+	sort.Ints(pids)
+
+	tables := make([]byte, 0, (1+len(pids))*tsPacketSize)
+	tables = append(tables, x.pat...)
+	for _, pid := range pids {
+		tables = append(tables, x.pmts[uint16(pid)]...)
+	}
+
+	return tables
+}
+
+// discontinuity returns the packets the stream resumes with after a gap: a packet with the
+// discontinuity_indicator for each stream, so the decoders reset their clocks and continuity
+// counters, followed by the tables.
+func (x *tsIndexer) discontinuity() []byte {
+	pmts := make([]int, 0, len(x.streams))
+	for pid := range x.streams {
+		pmts = append(pmts, int(pid))
+	}
+	sort.Ints(pmts)
+
+	packets := make([]byte, 0)
+	for _, pmt := range pmts {
+		for _, pid := range x.streams[uint16(pmt)] {
+			packets = append(packets, tsDiscontinuityPacket(pid)...)
+		}
+	}
+
+	return append(packets, x.tables()...)
+}
+
+// tsDiscontinuityPacket returns an adaptation field only packet of pid with the discontinuity_indicator set.
+func tsDiscontinuityPacket(pid uint16) []byte {
+	p := make([]byte, tsPacketSize)
+	p[0] = tsSyncByte
+	p[1] = byte(pid>>8) & 0x1f
+	p[2] = byte(pid)
+	// Adaptation field only, its continuity counter is not checked after the discontinuity
+	p[3] = 0x20
+	p[4] = tsPacketSize - 5
+	p[5] = 0x80
+	for i := 6; i < len(p); i++ {
+		p[i] = 0xff
+	}
+
+	return p
+}
+
+func isVideoStreamType(streamType byte) bool {
+	switch streamType {
+	case streamTypeMPEG1Video, streamTypeMPEG2Video, streamTypeMPEG4Video, streamTypeH264, streamTypeHEVC:
+		return true
+	}
+
+	return false
+}
+
+// esRandomAccess reports whether the PES packet starting in payload begins a keyframe:
+// an H.264 IDR or SPS, an HEVC IRAP or parameter set, an MPEG-2 sequence header.
+func esRandomAccess(payload []byte, streamType byte) bool {
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return false
+	}
+	es := payload[9:]
+	if hdr := int(payload[8]); hdr <= len(es) {
+		es = es[hdr:]
+	} else {
+		return false
+	}
+
+	for i := 0; i+3 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+
+		code := es[i+3]
+		switch streamType {
+		case streamTypeH264:
+			if t := code & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+		case streamTypeHEVC:
+			if t := (code >> 1) & 0x3f; (t >= 16 && t <= 21) || (t >= 32 && t <= 34) {
+				return true
+			}
+		case streamTypeMPEG1Video, streamTypeMPEG2Video:
+			if code == 0xb3 {
+				return true
+			}
+		case streamTypeMPEG4Video:
+			if code == 0xb0 || code == 0xb3 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// testTSPacket returns a packet of pid carrying payload, stuffed with 0xff.
+func testTSPacket(pid uint16, pusi, randomAccess bool, payload []byte) []byte {
+	p := make([]byte, tsPacketSize)
+	p[0] = tsSyncByte
+	p[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+
+	start := 4
+	if randomAccess {
+		p[3] = 0x30
+		p[4] = 1
+		p[5] = 0x40
+		start = 6
+	} else {
+		p[3] = 0x10
+	}
+	n := copy(p[start:], payload)
+	for i := start + n; i < tsPacketSize; i++ {
+		p[i] = 0xff
+	}
+
+	return p
+}
+
+func testPAT() []byte {
+	return testTSPacket(patPID, true, false, []byte{
+		0x00,             // pointer field
+		0x00, 0xb0, 0x0d, // table id, section length
+		0x00, 0x01, 0xc1, 0x00, 0x00, // transport stream id, version, section numbers
+		0x00, 0x01, 0xe0 | testPMTPID>>8, testPMTPID & 0xff, // program 1
+		0x00, 0x00, 0x00, 0x00, // CRC
+	})
+}
+
+func testPMT() []byte {
+	return testTSPacket(testPMTPID, true, false, []byte{
+		0x00,             // pointer field
+		0x02, 0xb0, 0x17, // table id, section length
+		0x00, 0x01, 0xc1, 0x00, 0x00, // program number, version, section numbers
+		0xe1, 0x00, 0xf0, 0x00, // PCR pid, program info length
+		streamTypeH264, 0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0x00,
+		0x0f, 0xe0 | testAudioPID>>8, testAudioPID & 0xff, 0xf0, 0x00,
+		0x00, 0x00, 0x00, 0x00, // CRC
+	})
+}
+
+// testVideoPES starts an H.264 access unit, an IDR one if keyframe.
+func testVideoPES(keyframe bool) []byte {
+	nal := byte(0x41)
+	if keyframe {
+		nal = 0x65
+	}
+
+	return testTSPacket(testVideoPID, true, false, []byte{
+		0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x09, 0xf0, // access unit delimiter
+		0x00, 0x00, 0x00, 0x01, nal,
+	})
+}
+
+func testVideoData() []byte {
+	return testTSPacket(testVideoPID, false, false, []byte{0x12, 0x34})
+}
+
+// writeInPieces writes data to the buffer in writes of n bytes.
+func writeInPieces(t *testing.T, sb *StreamBuffer, data []byte, n int) {
+	t.Helper()
+
+	for len(data) > 0 {
+		piece := data
+		if len(piece) > n {
+			piece = data[:n]
+		}
+		if _, err := sb.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+		data = data[len(piece):]
+	}
+}
+
+// readAvailable reads what the reader can read now.
+func readAvailable(t *testing.T, br *BufferReader) []byte {
+	t.Helper()
+
+	out := &bytes.Buffer{}
+	buf := make([]byte, 100)
+	for {
+		n, err := br.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return out.Bytes()
+		}
+		out.Write(buf[:n])
+	}
+}
+
+func TestTSIndexer(t *testing.T) {
+	x := newTSIndexer()
+	for _, p := range [][]byte{testPAT(), testPMT()} {
+		if x.inspect(p) {
+			t.Error("Expected the tables not to be random access points")
+		}
+	}
+	if !x.keyIsSet || x.keyPID != testVideoPID || x.keyType != streamTypeH264 {
+		t.Fatalf("Expected the H.264 stream to be the key stream, got pid %#x type %#x", x.keyPID, x.keyType)
+	}
+	if !bytes.Equal(x.tables(), append(testPAT(), testPMT()...)) {
+		t.Error("Expected the tables to be the PAT and the PMT")
+	}
+
+	want := append(tsDiscontinuityPacket(testVideoPID), tsDiscontinuityPacket(testAudioPID)...)
+	want = append(want, x.tables()...)
+	if got := x.discontinuity(); !bytes.Equal(got, want) {
+		t.Errorf("Expected a discontinuity packet of each stream followed by the tables, got %d bytes", len(got))
+	}
+	if p := tsPacket(tsDiscontinuityPacket(testAudioPID)); p.pid() != testAudioPID || p.payload() != nil || p[5]&0x80 == 0 {
+		t.Error("Expected an adaptation field only packet with the discontinuity indicator")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"IDR", testVideoPES(true), true},
+		{"non IDR", testVideoPES(false), false},
+		{"continuation", testVideoData(), false},
+		{"random access indicator", testTSPacket(testVideoPID, false, true, nil), true},
+		{"audio", testTSPacket(testAudioPID, true, true, nil), false},
+	} {
+		if got := x.inspect(tc.packet); got != tc.want {
+			t.Errorf("%s: inspect() = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStreamBufferMPEGTS(t *testing.T) {
+	t.Run("Chunks are aligned on the packets", func(t *testing.T) {
+		sb := NewStreamBuffer(100 * time.Millisecond)
+		defer sb.Close()
+
+		stream := append([]byte("garbage"), testPAT()...)
+		stream = append(stream, testPMT()...)
+		stream = append(stream, testVideoPES(true)...)
+		stream = append(stream, testVideoData()...)
+		stream = append(stream, testVideoData()...)
+		writeInPieces(t, sb, stream, 1000)
+
+		if sb.ts == nil {
+			t.Fatal("Expected the stream to be detected as MPEG-TS")
+		}
+		if sb.droppedBytes != int64(len("garbage")) {
+			t.Errorf("Expected the garbage to be dropped, got %d bytes dropped", sb.droppedBytes)
+		}
+		// PAT and PMT, then the keyframe chunk with the following packets
+		if sb.nextSeq != 2 || len(sb.keyframes) != 1 || sb.keyframes[0] != 1 {
+			t.Fatalf("Unexpected chunks: %d chunks, keyframes %v", sb.nextSeq, sb.keyframes)
+		}
+		for seq := sb.firstSeq; seq < sb.nextSeq; seq++ {
+			if data := sb.chunk(seq).Data; len(data)%tsPacketSize != 0 || data[0] != tsSyncByte {
+				t.Errorf("Chunk %d is not aligned on the packets", seq)
+			}
+		}
+	})
+
+	t.Run("The detection waits for three packets", func(t *testing.T) {
+		sb := NewStreamBuffer(0)
+		defer sb.Close()
+
+		// A radio whose first read holds a 'G', the sync byte
+		radio := append([]byte("ICY 200 OK\r\nicy-genre: Rock\r\n\r\n"), bytes.Repeat([]byte("mp3 frame "), 60)...)
+		writeInPieces(t, sb, radio, 100)
+		if sb.ts != nil || sb.droppedBytes != 0 || sb.totalBytes != int64(len(radio)) {
+			t.Errorf("Expected the radio to be buffered raw, got MPEG-TS %t with %d bytes dropped", sb.ts != nil, sb.droppedBytes)
+		}
+
+		sb = NewStreamBuffer(0)
+		defer sb.Close()
+		stream := append(testPAT(), testPMT()...)
+		stream = append(stream, testVideoPES(true)...)
+		writeInPieces(t, sb, stream, 100)
+		if sb.ts == nil || sb.nextSeq == 0 {
+			t.Error("Expected the stream written in short pieces to be detected as MPEG-TS")
+		}
+	})
+
+	t.Run("A short stream is buffered after the probe timeout", func(t *testing.T) {
+		sb := NewStreamBuffer(0)
+		defer sb.Close()
+
+		writeInPieces(t, sb, []byte("GGG"), 100)
+		time.Sleep(tsProbeTimeout + 100*time.Millisecond)
+
+		sb.mutex.RLock()
+		defer sb.mutex.RUnlock()
+		if !sb.detected || sb.ts != nil || sb.totalBytes != 3 {
+			t.Errorf("Expected the short stream to be buffered raw, got %d bytes", sb.totalBytes)
+		}
+	})
+
+	t.Run("A late reader starts with the tables and a keyframe", func(t *testing.T) {
+		sb := NewStreamBuffer(100 * time.Millisecond)
+		defer sb.Close()
+
+		first := append(testPAT(), testPMT()...)
+		first = append(first, testVideoPES(true)...)
+		first = append(first, testVideoData()...)
+		first = append(first, testVideoPES(false)...)
+		writeInPieces(t, sb, first, 100)
+
+		time.Sleep(300 * time.Millisecond)
+		second := append(testVideoData(), testVideoPES(true)...)
+		second = append(second, testVideoData()...)
+		writeInPieces(t, sb, second, 100)
+
+		// Joins mid-packet and mid-GOP, 100ms behind the second keyframe
+		reader := sb.NewReader("late")
+		defer sb.RemoveReader("late")
+		time.Sleep(150 * time.Millisecond)
+
+		want := append(testPAT(), testPMT()...)
+		want = append(want, testVideoPES(true)...)
+		want = append(want, testVideoData()...)
+		if got := readAvailable(t, reader); !bytes.Equal(got, want) {
+			t.Errorf("Expected the tables and the second keyframe, got %d bytes", len(got))
+		}
+	})
+
+	t.Run("A first reader waits for a keyframe", func(t *testing.T) {
+		sb := NewStreamBuffer(50 * time.Millisecond)
+		defer sb.Close()
+
+		reader := sb.NewReader("first")
+		defer sb.RemoveReader("first")
+
+		stream := append(testVideoData(), testPAT()...)
+		stream = append(stream, testPMT()...)
+		stream = append(stream, testVideoPES(false)...)
+		stream = append(stream, testVideoPES(true)...)
+		stream = append(stream, testVideoData()...)
+		writeInPieces(t, sb, stream, 188)
+		time.Sleep(100 * time.Millisecond)
+
+		want := append(testPAT(), testPMT()...)
+		want = append(want, testVideoPES(true)...)
+		want = append(want, testVideoData()...)
+		if got := readAvailable(t, reader); !bytes.Equal(got, want) {
+			t.Errorf("Expected the tables and the keyframe, got %d bytes", len(got))
+		}
+	})
+
+	t.Run("A reconnection resumes on a keyframe after a discontinuity", func(t *testing.T) {
+		sb := NewStreamBuffer(0)
+		sb.bufferTime = 0
+		defer sb.Close()
+
+		stream := append(testPAT(), testPMT()...)
+		stream = append(stream, testVideoPES(true)...)
+		writeInPieces(t, sb, append(stream, testVideoData()[:100]...), 1000)
+		reader := sb.NewReader("viewer")
+		defer sb.RemoveReader("viewer")
+		readAvailable(t, reader)
+
+		sb.discontinuity()
+		stream = append(testVideoData(), testVideoPES(false)...)
+		stream = append(stream, testVideoPES(true)...)
+		stream = append(stream, testVideoData()...)
+		writeInPieces(t, sb, stream, 100)
+
+		want := sb.ts.discontinuity()
+		want = append(want, testVideoPES(true)...)
+		want = append(want, testVideoData()...)
+		if got := readAvailable(t, reader); !bytes.Equal(got, want) {
+			t.Errorf("Expected the discontinuity, the tables and the keyframe, got %d bytes", len(got))
+		}
+		if sb.droppedBytes != 100+2*tsPacketSize {
+			t.Errorf("Expected the partial packet and the packets before the keyframe to be dropped, got %d bytes", sb.droppedBytes)
+		}
+	})
+
+	t.Run("An overrun reader resumes on a keyframe", func(t *testing.T) {
+		sb := NewStreamBuffer(0)
+		sb.bufferTime = 0
+		defer sb.Close()
+
+		writeInPieces(t, sb, append(testPAT(), testPMT()...), 188)
+		reader := sb.NewReader("slow")
+		defer sb.RemoveReader("slow")
+
+		for i := 0; i < sb.capacity+5; i++ {
+			writeInPieces(t, sb, append(testVideoPES(i%4 == 0), testVideoData()...), 376)
+		}
+
+		got := readAvailable(t, reader)
+		if !bytes.HasPrefix(got, append(append(testPAT(), testPMT()...), testVideoPES(true)...)) {
+			t.Error("Expected the overrun reader to resume with the tables and a keyframe")
+		}
+	})
+}
@@ -0,0 +1,331 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/jamesnetherton/m3u"
+)
+
+// trackTable is the routing table of the m3u proxy endpoints.
+// It is swapped as a whole each time the playlist is refreshed.
+type trackTable struct {
+	sync.RWMutex
+	tracks    []m3u.Track
+	ids       map[string]int
+	trackIDs  []string
+	streamIDs []int
+	streams   map[int]int
+}
+
+func newTrackTable() *trackTable {
+	return &trackTable{}
+}
+
+func (t *trackTable) set(tracks []m3u.Track) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.tracks = tracks
+	t.trackIDs = trackIDs(tracks)
+	t.streamIDs = numericIDs(t.trackIDs)
+	t.ids = make(map[string]int, len(tracks))
+	t.streams = make(map[int]int, len(tracks))
+	for i, id := range t.trackIDs {
+		t.ids[id] = i
+		t.streams[t.streamIDs[i]] = i
+	}
+}
+
+// snapshot returns the tracks with their ids and numeric stream ids.
+func (t *trackTable) snapshot() ([]m3u.Track, []string, []int) {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.tracks, t.trackIDs, t.streamIDs
+}
+
+// lookupStream returns the track of a numeric stream id and its track id.
+func (t *trackTable) lookupStream(streamID int) (*m3u.Track, string, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	index, ok := t.streams[streamID]
+	if !ok {
+		return nil, "", false
+	}
+
+	track := t.tracks[index]
+	return &track, t.trackIDs[index], true
+}
+
+// lookup returns the track routed under id.
+func (t *trackTable) lookup(id string) (*m3u.Track, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	index, ok := t.ids[id]
+	if !ok {
+		return nil, false
+	}
+
+	track := t.tracks[index]
+	return &track, true
+}
+
+// trackIDs returns a stable identifier for each track, derived from its origin
+// url, so adding or removing channels upstream doesn't change the proxyfied
+// url of the others. The rules never rewrite the url, renaming or regrouping
+// a channel keeps its id.
+func trackIDs(tracks []m3u.Track) []string {
+	ids := make([]string, len(tracks))
+	seen := make(map[string]int, len(tracks))
+	for i, track := range tracks {
+		h := sha1.New()
+		h.Write([]byte(track.URI)) // nolint: errcheck
+		id := hex.EncodeToString(h.Sum(nil))[:12]
+
+		// Same channel listed several times
+		seen[id]++
+		if n := seen[id]; n > 1 {
+			id = fmt.Sprintf("%s-%d", id, n)
+		}
+		ids[i] = id
+	}
+
+	return ids
+}
+
+// numericIDs returns a stable positive 31 bits id for each unique key,
+// for the xtream clients expecting numeric ids.
+func numericIDs(keys []string) []int {
+	ids := make([]int, len(keys))
+	used := make(map[int]bool, len(keys))
+	for i, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key)) // nolint: errcheck
+
+		id := int(h.Sum32() & 0x7fffffff)
+		for id == 0 || used[id] {
+			id = (id + 1) & 0x7fffffff
+		}
+		used[id] = true
+		ids[i] = id
+	}
+
+	return ids
+}
+
+// writeProxyfiedM3U apply the rules to the playlist, write the proxyfied m3u
+// file of each user and swap the routing table.
+func (c *Config) writeProxyfiedM3U() error {
+	tracks := c.rules.Apply(c.playlist.Tracks)
+
+	for _, account := range c.users.list() {
+		tmp := *c
+		tmp.account = account
+		tmp.playlist = &m3u.Playlist{Tracks: tracks}
+		if err := tmp.writeM3UFile(c.accountM3UPath(account)); err != nil {
+			return err
+		}
+	}
+
+	c.epgOffsets.set(c.rules.EPGOffsets(c.playlist.Tracks))
+	c.playlist.Tracks = tracks
+	c.tracks.set(tracks)
+
+	return nil
+}
+
+// writeM3UFile marshall the playlist into a temporary file and move it
+// over path, so clients never download a partial playlist.
+func (c *Config) writeM3UFile(path string) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err := c.marshallInto(f, false); err != nil {
+		f.Close()          // nolint: errcheck
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// accountM3UPath returns the path to the proxyfied m3u file of the account.
+func (c *Config) accountM3UPath(account *config.Account) string {
+	return c.proxyfiedM3UPath + "." + url.QueryEscape(account.Username.String())
+}
+
+// m3uSources holds the tracks of each upstream m3u source.
+type m3uSources struct {
+	sync.Mutex
+	sources []config.M3USource
+	tracks  [][]m3u.Track
+}
+
+func newM3USources(proxyConfig *config.ProxyConfig) *m3uSources {
+	sources := proxyConfig.M3USources
+	if len(sources) == 0 && proxyConfig.RemoteURL != nil && proxyConfig.RemoteURL.String() != "" {
+		sources = []config.M3USource{{URL: proxyConfig.RemoteURL}}
+	}
+
+	return &m3uSources{
+		sources: sources,
+		tracks:  make([][]m3u.Track, len(sources)),
+	}
+}
+
+// parse fetch the source i and tag its tracks.
+func (s *m3uSources) parse(i int) ([]m3u.Track, error) {
+	src := s.sources[i]
+
+	p, err := m3u.Parse(src.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf("m3u source %q: %v", src.URL, err)
+	}
+
+	for j := range p.Tracks {
+		track := &p.Tracks[j]
+		if src.Prefix != "" {
+			track.Name = src.Prefix + track.Name
+		}
+		if src.Group != "" {
+			rules.SetTag(track, "group-title", src.Group)
+		}
+	}
+
+	return p.Tracks, nil
+}
+
+// merge returns the tracks of all sources, a track with a tvg-id already
+// provided by a previous source is dropped.
+// The caller must hold the lock.
+func (s *m3uSources) merge() []m3u.Track {
+	merged := make([]m3u.Track, 0)
+	seen := make(map[string]bool)
+
+	for _, tracks := range s.tracks {
+		for _, track := range tracks {
+			if id := rules.Tag(track, "tvg-id"); id != "" {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+			}
+			merged = append(merged, track)
+		}
+	}
+
+	return merged
+}
+
+// loadPlaylist parse all the m3u sources and merge them into the playlist.
+func (c *Config) loadPlaylist() error {
+	c.sources.Lock()
+	defer c.sources.Unlock()
+
+	for i := range c.sources.sources {
+		tracks, err := c.sources.parse(i)
+		if err != nil {
+			return err
+		}
+		c.sources.tracks[i] = tracks
+	}
+
+	c.playlist = &m3u.Playlist{Tracks: c.sources.merge()}
+
+	return nil
+}
+
+// refreshSource parse the source i again and swap the proxyfied m3u
+// file and the routing table. Streams already started are left untouched.
+func (c *Config) refreshSource(i int) error {
+	tracks, err := c.sources.parse(i)
+	if err != nil {
+		return err
+	}
+
+	c.sources.Lock()
+	defer c.sources.Unlock()
+
+	c.sources.tracks[i] = tracks
+
+	tmp := *c
+	tmp.playlist = &m3u.Playlist{Tracks: c.sources.merge()}
+	if err := tmp.writeProxyfiedM3U(); err != nil {
+		return err
+	}
+
+	log.Printf("[iptv-proxy] Playlist refreshed from %s: %d tracks", c.sources.sources[i].URL, len(tracks))
+
+	return nil
+}
+
+// playlistRefreshers start a refresher for each m3u source.
+func (c *Config) playlistRefreshers() {
+	for i, src := range c.sources.sources {
+		interval := src.Refresh
+		if interval == 0 {
+			interval = time.Duration(c.M3UCacheExpiration) * time.Hour
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		go c.playlistRefresher(i, interval)
+	}
+}
+
+// playlistRefresher refresh the source i every interval.
+func (c *Config) playlistRefresher(i int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.refreshSource(i); err != nil {
+				log.Printf("[iptv-proxy] WARNING: unable to refresh playlist: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/jamesnetherton/m3u"
+)
+
+func writePlaylist(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write playlist: %v", err)
+	}
+}
+
+func newTestM3UServer(t *testing.T, playlistPath string) *Config {
+	t.Helper()
+
+	remoteURL, _ := url.Parse(playlistPath)
+	serverConfig, err := NewServer(&config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname: "localhost",
+			Port:     8080,
+		},
+		RemoteURL:      remoteURL,
+		User:           "test",
+		Password:       "test",
+		AdvertisedPort: 8080,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	serverConfig.proxyfiedM3UPath = filepath.Join(filepath.Dir(playlistPath), "proxyfied.m3u")
+
+	return serverConfig
+}
+
+func TestPlaylistRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+#EXTINF:-1 tvg-id="two" group-title="News",Channel Two
+http://example.com/two.ts
+`)
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	removedID := trackIDs(serverConfig.playlist.Tracks)[1]
+	if _, ok := serverConfig.tracks.lookup(removedID); !ok {
+		t.Fatal("Expected track two to be routed")
+	}
+
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="three" group-title="News",Channel Three
+http://example.com/three.ts
+`)
+
+	if err := serverConfig.refreshSource(0); err != nil {
+		t.Fatalf("Failed to refresh playlist: %v", err)
+	}
+
+	_, ids, _ := serverConfig.tracks.snapshot()
+	track, ok := serverConfig.tracks.lookup(ids[0])
+	if !ok || track.URI != "http://example.com/three.ts" {
+		t.Errorf("Expected the new channel to be routed, got %+v", track)
+	}
+	if _, ok := serverConfig.tracks.lookup(removedID); ok {
+		t.Error("Expected removed track to be unrouted")
+	}
+
+	content, err := ioutil.ReadFile(serverConfig.accountM3UPath(serverConfig.users.list()[0]))
+	if err != nil {
+		t.Fatalf("Failed to read proxyfied playlist: %v", err)
+	}
+	if !strings.Contains(string(content), "Channel Three") || strings.Contains(string(content), "Channel One") {
+		t.Errorf("Proxyfied playlist was not regenerated:\n%s", content)
+	}
+}
+
+func TestStableTrackIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="two" group-title="News",Channel Two
+http://example.com/two.ts
+`)
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+	id := trackIDs(serverConfig.playlist.Tracks)[0]
+
+	content, err := ioutil.ReadFile(serverConfig.accountM3UPath(serverConfig.users.list()[0]))
+	if err != nil {
+		t.Fatalf("Failed to read proxyfied playlist: %v", err)
+	}
+	if !strings.Contains(string(content), "/test/test/"+id+"/two.ts") {
+		t.Errorf("Expected stable id %q in proxyfied playlist:\n%s", id, content)
+	}
+
+	// A new channel on top of the playlist must not change the others ids
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+#EXTINF:-1 tvg-id="two" group-title="News",Channel Two
+http://example.com/two.ts
+`)
+	if err := serverConfig.refreshSource(0); err != nil {
+		t.Fatalf("Failed to refresh playlist: %v", err)
+	}
+
+	track, ok := serverConfig.tracks.lookup(id)
+	if !ok || track.URI != "http://example.com/two.ts" {
+		t.Errorf("Expected stable id to still route to channel two, got %+v", track)
+	}
+
+	if _, ok := serverConfig.tracks.lookup("0"); ok {
+		t.Error("Expected the positional index not to be routed")
+	}
+
+	// Renaming and regrouping a channel with the rules must not change its id
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	writePlaylist(t, rulesPath, "rules:\n  - name: Two\n    rename: Deux\n    set:\n      group-title: Infos\n      tvg-id: deux\n")
+	if serverConfig.rules, err = rules.Load(rulesPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverConfig.refreshSource(0); err != nil {
+		t.Fatalf("Failed to refresh playlist: %v", err)
+	}
+
+	track, ok = serverConfig.tracks.lookup(id)
+	if !ok || track.Name != "Channel Deux" {
+		t.Errorf("Expected stable id to route to the rewritten channel two, got %+v", track)
+	}
+}
+
+func TestTrackIDsDuplicates(t *testing.T) {
+	tracks := []m3u.Track{
+		{Name: "Channel", URI: "http://example.com/1.ts"},
+		{Name: "Channel", URI: "http://example.com/1.ts"},
+	}
+	ids := trackIDs(tracks)
+	if ids[0] == ids[1] {
+		t.Errorf("Expected duplicated tracks to get distinct ids, got %v", ids)
+	}
+}
+
+func TestMergeM3USources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	firstPath := filepath.Join(dir, "first.m3u")
+	writePlaylist(t, firstPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://first.com/one.ts
+`)
+	secondPath := filepath.Join(dir, "second.m3u")
+	writePlaylist(t, secondPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://second.com/one.ts
+#EXTINF:-1 tvg-id="local" group-title="Local",Local Channel
+http://second.com/local.ts
+`)
+
+	first, err := config.ParseM3USource(firstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := config.ParseM3USource(secondPath + "|prefix=FTA: |group=Free|refresh=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Refresh.Minutes() != 30 {
+		t.Errorf("Expected a 30m refresh interval, got %v", second.Refresh)
+	}
+
+	serverConfig, err := NewServer(&config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname: "localhost",
+			Port:     8080,
+		},
+		RemoteURL:      first.URL,
+		M3USources:     []config.M3USource{first, second},
+		User:           "test",
+		Password:       "test",
+		AdvertisedPort: 8080,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	serverConfig.proxyfiedM3UPath = filepath.Join(dir, "proxyfied.m3u")
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	tracks := serverConfig.playlist.Tracks
+	if len(tracks) != 2 {
+		t.Fatalf("Expected 2 merged tracks, got %d", len(tracks))
+	}
+	if tracks[0].URI != "http://first.com/one.ts" {
+		t.Errorf("Expected the first source to win on duplicated tvg-id, got %s", tracks[0].URI)
+	}
+	if tracks[1].Name != "FTA: Local Channel" || rules.Tag(tracks[1], "group-title") != "Free" {
+		t.Errorf("Expected second source tracks to be tagged, got %+v", tracks[1])
+	}
+
+	id := trackIDs(tracks)[1]
+	track, ok := serverConfig.tracks.lookup(id)
+	if !ok || track.URI != "http://second.com/local.ts" {
+		t.Errorf("Expected %s to be routed to the second source, got %+v", id, track)
+	}
+}
@@ -20,7 +20,6 @@ package server
 
 import (
 	"fmt"
-	"path"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -34,13 +33,21 @@ func (c *Config) routes(r *gin.RouterGroup) {
 		r.GET("/buffer-stats", c.authenticate, c.bufferStats)
 	}
 
+	r.GET("/metrics", c.authenticate, c.metrics)
+
+	// The image urls are signed, the clients load them without credentials
+	if c.images != nil {
+		r.GET("/images/:sig/:name", c.serveImage)
+	}
+
+	if c.HDHomeRun || c.SSDP {
+		c.hdhrRoutes(r)
+	}
+
 	//Xtream service endopoints
 	if c.ProxyConfig.XtreamBaseURL != "" {
 		c.xtreamRoutes(r)
-		if strings.Contains(c.XtreamBaseURL, c.RemoteURL.Host) &&
-			c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
-			c.XtreamPassword.String() == c.RemoteURL.Query().Get("password") {
-
+		if c.xtreamAuto() {
 			r.GET("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
 			// XXX Private need: for external Android app
 			r.POST("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
@@ -49,9 +56,44 @@ func (c *Config) routes(r *gin.RouterGroup) {
 		}
 	}
 
+	if c.xtreamEmulated() {
+		c.xtreamEmulationRoutes(r)
+	}
+
 	c.m3uRoutes(r)
 }
 
+// streamRoutes registers only the stream endpoints, for the plain HTTP listener.
+func (c *Config) streamRoutes(r *gin.RouterGroup) {
+	r = r.Group(c.CustomEndpoint)
+
+	if c.images != nil {
+		r.GET("/images/:sig/:name", c.serveImage)
+	}
+
+	if c.ProxyConfig.XtreamBaseURL != "" {
+		c.xtreamStreamRoutes(r)
+		if c.xtreamAuto() {
+			return
+		}
+	}
+
+	if c.xtreamEmulated() {
+		c.xtreamEmulationStreamRoutes(r)
+	}
+
+	c.m3uStreamRoutes(r)
+}
+
+// xtreamAuto reports whether the m3u url is the get.php endpoint of the xtream server.
+// Several m3u sources are always merged into a proxyfied m3u file.
+func (c *Config) xtreamAuto() bool {
+	return c.XtreamBaseURL != "" && len(c.M3USources) <= 1 &&
+		strings.Contains(c.XtreamBaseURL, c.RemoteURL.Host) &&
+		c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
+		c.XtreamPassword.String() == c.RemoteURL.Query().Get("password")
+}
+
 func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	getphp := gin.HandlerFunc(c.xtreamGet)
 	if c.XtreamGenerateApiGet {
@@ -62,13 +104,17 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET("/apiget", c.authenticate, c.xtreamApiGet)
 	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
 	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
-	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
-	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
-	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
-	r.GET(fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), c.xtreamStreamTimeshift)
-	r.GET(fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), c.xtreamStreamMovie)
-	r.GET(fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), c.xtreamStreamSeries)
-	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
+	r.GET("/xmltv.php", c.authenticate, c.serveXMLTV)
+	c.xtreamStreamRoutes(r)
+}
+
+func (c *Config) xtreamStreamRoutes(r *gin.RouterGroup) {
+	r.GET("/:username/:password/:id", c.pathAuthenticate, c.xtreamStreamHandler)
+	r.GET("/live/:username/:password/:id", c.pathAuthenticate, c.xtreamStreamLive)
+	r.GET("/timeshift/:username/:password/:duration/:start/:id", c.pathAuthenticate, c.xtreamStreamTimeshift)
+	r.GET("/movie/:username/:password/:id", c.pathAuthenticate, c.xtreamStreamMovie)
+	r.GET("/series/:username/:password/:id", c.pathAuthenticate, c.xtreamStreamSeries)
+	r.GET("/hlsr/:token/:username/:password/:channel/:hash/:chunk", c.pathAuthenticate, c.xtreamHlsrStream)
 	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
 	r.GET("/play/:token/:type", c.xtreamStreamPlay)
 }
@@ -78,16 +124,17 @@ func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 	// XXX Private need: for external Android app
 	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
 
-	for i, track := range c.playlist.Tracks {
-		trackConfig := &Config{
-			ProxyConfig: c.ProxyConfig,
-			track:       &c.playlist.Tracks[i],
-		}
+	// The xtream routes serve the provider guide
+	if (c.XMLTVURL != "" || len(c.XMLTVSources) > 0) && c.XtreamBaseURL == "" {
+		r.GET("/xmltv.php", c.authenticate, c.serveXMLTV)
+	}
 
-		if strings.HasSuffix(track.URI, ".m3u8") {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/:id", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3u8ReverseProxy)
-		} else {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
-		}
+	c.m3uStreamRoutes(r)
+}
+
+func (c *Config) m3uStreamRoutes(r *gin.RouterGroup) {
+	r.GET(fmt.Sprintf("/%s/:username/:password/:track/:id", c.endpointAntiColision), c.pathAuthenticate, c.m3uTrack)
+	if c.timeshift != nil {
+		r.GET(fmt.Sprintf("/%s/timeshift/:username/:password/:minutes/:track/:id", c.endpointAntiColision), c.pathAuthenticate, c.m3uTimeshift)
 	}
 }
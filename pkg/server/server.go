@@ -20,21 +20,24 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/jamesnetherton/m3u"
 	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	xtreamapi "github.com/incmve/iptv-proxy/pkg/xtream-proxy"
 	uuid "github.com/satori/go.uuid"
-
-	"github.com/gin-gonic/gin"
 )
 
 var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
@@ -48,46 +51,136 @@ type Config struct {
 	playlist *m3u.Playlist
 	// this variable is set only for m3u proxy endpoints
 	track *m3u.Track
+	// this variable is set only for endpoints serving a user playlist
+	account *config.Account
+	// the playlist is already filtered for the account, its group titles may be prefixed
+	accountFiltered bool
 	// path to the proxyfied m3u file
 	proxyfiedM3UPath string
+	// tracks served by the m3u proxy endpoints
+	tracks *trackTable
+	// upstream m3u playlists
+	sources *m3uSources
+	// proxy users
+	users *userStore
+	// playlist filtering and rewriting rules
+	rules *rules.Ruleset
+	// authenticated xtream clients sharing the API response cache
+	xtreamClients *xtreamapi.Pool
+	// copy on disk of the XMLTV guide, nil if disabled
+	xmltv *xmltvCache
+	// guide offsets of the playlist channels
+	epgOffsets *epgOffsets
+	// programmes of the guide by channel, for the emulated xtream EPG
+	programmes *programmeIndex
+	// proxy of the logos and artworks, nil if disabled
+	images *imageProxy
+	// recordings of the buffered streams, nil if disabled
+	timeshift *timeshiftStore
+	// closed when the server shuts down
+	done chan struct{}
 
 	endpointAntiColision string
 }
 
 // NewServer initialize a new server configuration
 func NewServer(config *config.ProxyConfig) (*Config, error) {
-	var p m3u.Playlist
-	if config.RemoteURL.String() != "" {
+	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
+		endpointAntiColision = trimmedCustomId
+	}
+
+	var rs *rules.Ruleset
+	if config.RulesFile != "" {
 		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
+		rs, err = rules.Load(config.RulesFile)
 		if err != nil {
 			return nil, err
 		}
+		log.Printf("[iptv-proxy] %d playlist rules loaded from %s", len(rs.Rules), config.RulesFile)
 	}
 
-	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
-		endpointAntiColision = trimmedCustomId
+	accounts, err := proxyAccounts(config)
+	if err != nil {
+		return nil, err
 	}
 
 	serverConfig := &Config{
 		ProxyConfig:          config,
-		playlist:             &p,
+		playlist:             &m3u.Playlist{},
 		track:                nil,
 		proxyfiedM3UPath:     defaultProxyfiedM3UPath,
+		tracks:               newTrackTable(),
+		sources:              newM3USources(config),
+		users:                newUserStore(accounts),
+		rules:                rs,
+		xtreamClients:        xtreamapi.NewPool(config.XtreamCacheTTLs),
+		epgOffsets:           newEPGOffsets(),
+		programmes:           &programmeIndex{},
+		done:                 make(chan struct{}),
 		endpointAntiColision: endpointAntiColision,
 	}
 
+	switch source := serverConfig.xmltvSource(); {
+	case len(config.XMLTVSources) > 0:
+		if config.XMLTVCacheRefresh <= 0 {
+			return nil, fmt.Errorf("the merged xmltv guide is cached on disk, --xmltv-cache-refresh can't be disabled")
+		}
+		serverConfig.xmltv = serverConfig.newMergedXMLTVCache()
+	case strings.HasPrefix(source, "http") && config.XMLTVCacheRefresh > 0:
+		serverConfig.xmltv = newXMLTVCache(source, config.XMLTVCacheRefresh)
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+	// The urls served by the TLS listener are https
+	if config.TLSCert != "" {
+		config.HTTPS = true
+	}
+
+	// The tuner clients can't authenticate, the user whose credentials the lineup exposes is explicit
+	if config.HDHomeRun || config.SSDP {
+		if _, err := serverConfig.hdhrAccount(); err != nil {
+			return nil, fmt.Errorf("the HDHomeRun tuner requires --hdhr-user, the user whose playlist it serves: %v", err)
+		}
+	}
+
+	if config.ImageProxy {
+		if serverConfig.images, err = newImageProxy(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := serverConfig.loadPlaylist(); err != nil {
+		return nil, err
+	}
+
+	GetConnectionAccountant().SetAccounts(serverConfig.upstreamAccounts(), config.UpstreamPreempt)
+	serverConfig.resolveConnectionLimits()
+
 	// Initialize buffer manager with configuration
 	if config.BufferEnabled {
 		bufferManager := GetBufferManager()
 		bufferDuration := time.Duration(config.BufferDuration) * time.Second
 		bufferManager.SetBufferDuration(bufferDuration)
-		log.Printf("[iptv-proxy] Buffer enabled: duration=%ds, max_memory=%dMB, preload=%ds", 
-			config.BufferDuration, config.BufferMaxMemory, config.BufferPreload)
+		bufferManager.SetMemoryLimits(int64(config.BufferMaxMemory)*1024*1024, int64(config.BufferTotalMemory)*1024*1024)
+		log.Printf("[iptv-proxy] Buffer enabled: duration=%ds, max_memory=%dMB, total_memory=%dMB, preload=%ds", 
+			config.BufferDuration, config.BufferMaxMemory, config.BufferTotalMemory, config.BufferPreload)
 	} else {
 		log.Printf("[iptv-proxy] Buffer disabled")
 	}
 
+	if config.TimeshiftRetention > 0 {
+		if !config.BufferEnabled {
+			return nil, fmt.Errorf("timeshift records the buffered streams, it requires --buffer-enabled")
+		}
+		if serverConfig.timeshift, err = newTimeshiftStore(config); err != nil {
+			return nil, err
+		}
+		GetBufferManager().setTimeshift(serverConfig.timeshift)
+		log.Printf("[iptv-proxy] Timeshift enabled: retention=%v, quota=%dMB", config.TimeshiftRetention, config.TimeshiftQuota)
+	}
+
 	return serverConfig, nil
 }
 
@@ -97,53 +190,148 @@ func (c *Config) Serve() error {
 		return err
 	}
 
-	router := gin.Default()
-	router.Use(cors.Default())
-	group := router.Group("/")
-	c.routes(group)
+	if !c.xtreamAuto() {
+		c.playlistRefreshers()
+	}
+
+	if c.xmltv != nil {
+		go c.xmltv.refresher(c.done)
+	}
+
+	if c.timeshift != nil {
+		go c.timeshift.janitor(c.done)
+	}
+
+	servers, err := c.servers()
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- listen(server)
+		}(server)
+	}
+
+	if c.SSDP {
+		if err := c.startSSDP(); err != nil {
+			log.Printf("[iptv-proxy] WARNING: %v", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
 	// Add a message to indicate the server is ready
-	log.Printf("[iptv-proxy] Server is ready and listening on :%d", c.HostConfig.Port)
+	for _, server := range servers {
+		log.Printf("[iptv-proxy] Server is ready and listening on %s (tls: %t)", server.Addr, server.TLSConfig != nil)
+	}
 
-	return router.Run(fmt.Sprintf(":%d", c.HostConfig.Port))
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("[iptv-proxy] Received %v, shutting down", sig)
+	}
+
+	return c.shutdown(servers...)
 }
 
-func (c *Config) playlistInitialization() error {
-	if len(c.playlist.Tracks) == 0 {
-		return nil
+// shutdown stops accepting requests, stops the streams and lets the in-flight
+// requests finish within the shutdown timeout, then removes the temporary files.
+func (c *Config) shutdown(servers ...*http.Server) error {
+	close(c.done)
+
+	ctx := context.Background()
+	if c.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.ShutdownTimeout)*time.Second)
+		defer cancel()
 	}
 
-	f, err := os.Create(c.proxyfiedM3UPath)
+	shutdownErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			shutdownErr <- server.Shutdown(ctx)
+		}(server)
+	}
+
+	// Streams never end by themselves, stop them so their requests can finish
+	GetBufferManager().CloseAll()
+	GetConnectionAccountant().CancelAll()
+
+	var err error
+	for range servers {
+		if e := <-shutdownErr; e != nil {
+			err = e
+		}
+	}
 	if err != nil {
-		return err
+		for _, server := range servers {
+			server.Close() // nolint: errcheck
+		}
+	}
+	c.removeTempFiles()
+
+	if err != nil {
+		return fmt.Errorf("shutdown deadline exceeded: %v", err)
+	}
+
+	log.Printf("[iptv-proxy] Server stopped")
+	return nil
+}
+
+// removeTempFiles removes the proxyfied and cached m3u files.
+func (c *Config) removeTempFiles() {
+	for _, account := range c.users.list() {
+		if err := os.Remove(c.accountM3UPath(account)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[iptv-proxy] WARNING: unable to remove temporary playlist: %v", err)
+		}
 	}
-	defer f.Close()
 
-	return c.marshallInto(f, false)
+	clearXtreamM3uCache()
+}
+
+func (c *Config) playlistInitialization() error {
+	if len(c.playlist.Tracks) == 0 {
+		return nil
+	}
+
+	return c.writeProxyfiedM3U()
 }
 
 // MarshallInto a *bufio.Writer a Playlist.
 func (c *Config) marshallInto(into *os.File, xtream bool) error {
 	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
 
-	ret := 0
+	ids := trackIDs(c.playlist.Tracks)
+
 	into.WriteString("#EXTM3U\n") // nolint: errcheck
 	for i, track := range c.playlist.Tracks {
+		if c.account != nil && !c.accountFiltered && !c.account.AllowGroup(rules.Tag(track, "group-title")) {
+			continue
+		}
+
 		var buffer bytes.Buffer
 
 		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
 		buffer.WriteString(fmt.Sprintf("%d ", track.Length)) // nolint: errcheck
 		for i := range track.Tags {
+			value := track.Tags[i].Value
+			if strings.EqualFold(track.Tags[i].Name, "tvg-logo") {
+				value = c.imageURL(value)
+			}
 			if i == len(track.Tags)-1 {
-				buffer.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
+				buffer.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, value)) // nolint: errcheck
 				continue
 			}
-			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
+			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, value)) // nolint: errcheck
 		}
 
-		uri, err := c.replaceURL(track.URI, i-ret, xtream)
+		uri, err := c.replaceURL(track.URI, ids[i], xtream)
 		if err != nil {
-			ret++
 			log.Printf("ERROR: track: %s: %s", track.Name, err)
 			continue
 		}
@@ -158,7 +346,7 @@ func (c *Config) marshallInto(into *os.File, xtream bool) error {
 }
 
 // ReplaceURL replace original playlist url by proxy url
-func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, error) {
+func (c *Config) replaceURL(uri string, trackID string, xtream bool) (string, error) {
 	oriURL, err := url.Parse(uri)
 	if err != nil {
 		return "", err
@@ -174,12 +362,14 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 		customEnd = fmt.Sprintf("/%s", customEnd)
 	}
 
+	user, password := c.credentials()
+
 	uriPath := oriURL.EscapedPath()
 	if xtream {
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), c.User.PathEscape())
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), c.Password.PathEscape())
+		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), user.PathEscape())
+		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), password.PathEscape())
 	} else {
-		uriPath = path.Join("/", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape(), fmt.Sprintf("%d", trackIndex), path.Base(uriPath))
+		uriPath = path.Join("/", c.endpointAntiColision, user.PathEscape(), password.PathEscape(), trackID, path.Base(uriPath))
 	}
 
 	basicAuth := oriURL.User.String()
@@ -204,3 +394,64 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 
 	return newURL.String(), nil
 }
+
+// credentials returns the credentials written into the proxyfied urls.
+func (c *Config) credentials() (config.CredentialString, config.CredentialString) {
+	if c.account != nil {
+		return c.account.Username, c.account.Password
+	}
+
+	return c.User, c.Password
+}
+
+// upstreamAccounts returns the ordered provider accounts and their connection limits.
+// Without --max-upstream-connections the xtream accounts are unlimited until
+// resolveConnectionLimits gets their limits from the provider.
+func (c *Config) upstreamAccounts() []UpstreamAccount {
+	limit := c.MaxUpstreamConnections
+	if limit < 0 {
+		limit = 0
+	}
+
+	xtreamAccounts := c.XtreamAccounts()
+	if len(xtreamAccounts) == 0 {
+		return []UpstreamAccount{{Limit: limit}}
+	}
+
+	accounts := make([]UpstreamAccount, 0, len(xtreamAccounts))
+	for _, xtreamAccount := range xtreamAccounts {
+		accounts = append(accounts, UpstreamAccount{XtreamAccount: xtreamAccount, Limit: limit})
+	}
+
+	return accounts
+}
+
+// resolveConnectionLimits sets in the background the connection limit of each xtream account
+// to the one of its provider, so an unreachable provider doesn't delay the start.
+func (c *Config) resolveConnectionLimits() {
+	if c.MaxUpstreamConnections != 0 {
+		return
+	}
+
+	for _, account := range c.XtreamAccounts() {
+		go func(account config.XtreamAccount) {
+			if limit := xtreamConnectionLimit(account); limit > 0 {
+				GetConnectionAccountant().SetLimit(account, limit)
+			}
+		}(account)
+	}
+}
+
+// xtreamConnectionLimit returns the maximum streams the provider allows for the account.
+func xtreamConnectionLimit(account config.XtreamAccount) int {
+	client, err := xtreamapi.New(account.User.String(), account.Password.String(), account.BaseURL, "")
+	if err != nil {
+		log.Printf("[iptv-proxy] WARNING: unable to get the xtream max connections of %s: %v", account.User, err)
+		return 0
+	}
+
+	limit := int(client.UserInfo.MaxConnections)
+	log.Printf("[iptv-proxy] Provider allows %d concurrent connections for %s", limit, account.User)
+
+	return limit
+}
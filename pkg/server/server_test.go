@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stream data")) // nolint: errcheck
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer source.Close()
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+`+source.URL+`/one
+`)
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.ShutdownTimeout = 5
+	serverConfig.BufferEnabled = true
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+	playlistFile := serverConfig.accountM3UPath(serverConfig.users.list()[0])
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+	server := &http.Server{Handler: router}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener) // nolint: errcheck
+
+	// A client watching a buffered channel
+	trackID := trackIDs(serverConfig.playlist.Tracks)[0]
+	resp, err := http.Get("http://" + listener.Addr().String() + "/" + serverConfig.endpointAntiColision + "/test/test/" + trackID + "/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	if err := serverConfig.shutdown(server); err != nil {
+		t.Fatalf("Expected a clean shutdown: %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("Expected the stream to be stopped, shutdown took %v", time.Since(start))
+	}
+
+	if _, err := os.Stat(playlistFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the proxyfied playlist to be removed, got %v", err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/iptv.m3u"); err == nil {
+		t.Error("Expected new requests to be refused")
+	}
+}
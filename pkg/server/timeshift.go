@@ -0,0 +1,609 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+const (
+	// timeshiftSegmentDuration is the stream time of a segment file, cut on the next keyframe
+	timeshiftSegmentDuration = 10 * time.Second
+	// timeshiftStartLayout is the start time of the xtream timeshift urls
+	timeshiftStartLayout = "2006-01-02:15-04"
+)
+
+// timeshiftQueueSize is the number of chunks waiting to be written on disk, the recording
+// drops chunks beyond it rather than slowing down the buffer
+const timeshiftQueueSize = 256
+
+// timeshiftCheckInterval is the interval the retention, the quota and the idle channels are checked at
+var timeshiftCheckInterval = 30 * time.Second
+
+// timeshiftPollInterval is how often a reader at the live edge checks for new data
+var timeshiftPollInterval = 200 * time.Millisecond
+
+// timeshiftStore records the buffered live streams in rolling segment files on disk,
+// so the clients can start their playback back in time.
+type timeshiftStore struct {
+	sync.Mutex
+	dir       string
+	retention time.Duration
+	quota     int64
+	idle      time.Duration
+	// recordings by upstream stream url
+	channels map[string]*timeshiftChannel
+	// wakes up the janitor when a segment is added
+	check chan struct{}
+}
+
+// timeshiftChannel is the recording of a stream
+type timeshiftChannel struct {
+	sync.RWMutex
+	dir   string
+	check chan struct{}
+	// oldest first, the last one is being written while file is open
+	segments  []*timeshiftSegment
+	file      *os.File
+	nextID    int64
+	lastWrite time.Time
+	failed    bool
+}
+
+// timeshiftSegment is a file of the recording, the segments of an MPEG-TS stream start
+// with the tables and a keyframe to be played on their own.
+type timeshiftSegment struct {
+	id         int64
+	path       string
+	start, end time.Time
+	size       int64
+}
+
+func newTimeshiftStore(proxyConfig *config.ProxyConfig) (*timeshiftStore, error) {
+	dir := proxyConfig.TimeshiftDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "iptv-proxy-timeshift")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create the timeshift folder: %v", err)
+	}
+	// The segments are indexed in memory, the recordings of a previous run can't be played
+	if err := cleanTimeshiftDir(dir); err != nil {
+		return nil, fmt.Errorf("unable to clean the timeshift folder: %v", err)
+	}
+
+	return &timeshiftStore{
+		dir:       dir,
+		retention: proxyConfig.TimeshiftRetention,
+		quota:     int64(proxyConfig.TimeshiftQuota) * 1024 * 1024,
+		idle:      proxyConfig.TimeshiftIdle,
+		channels:  make(map[string]*timeshiftChannel),
+		check:     make(chan struct{}, 1),
+	}, nil
+}
+
+// cleanTimeshiftDir removes the recordings left in dir, the other files are kept.
+func cleanTimeshiftDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !isRecordingDir(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isRecordingDir reports whether name is the folder of a recording, named after the hash of its stream url.
+func isRecordingDir(name string) bool {
+	if len(name) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// channel returns the recording of a stream, created if needed.
+func (s *timeshiftStore) channel(streamURL string) *timeshiftChannel {
+	s.Lock()
+	defer s.Unlock()
+
+	if ch, ok := s.channels[streamURL]; ok {
+		return ch
+	}
+
+	h := sha1.Sum([]byte(streamURL))
+	ch := &timeshiftChannel{
+		dir:   filepath.Join(s.dir, hex.EncodeToString(h[:8])),
+		check: s.check,
+	}
+	s.channels[streamURL] = ch
+
+	return ch
+}
+
+// lookup returns the recording of a stream, nil if the stream has none.
+func (s *timeshiftStore) lookup(streamURL string) *timeshiftChannel {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ch, ok := s.channels[streamURL]
+	if !ok || ch.empty() {
+		return nil
+	}
+	return ch
+}
+
+// janitor enforces the retention, the quota and drops the recordings of the idle channels
+// until done is closed.
+func (s *timeshiftStore) janitor(done <-chan struct{}) {
+	ticker := time.NewTicker(timeshiftCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-s.check:
+		}
+		s.cleanup(time.Now())
+	}
+}
+
+// cleanup drops the segments older than the retention, the recordings of the channels idle
+// for longer than the idle time, then the oldest segments until the recordings fit in the quota.
+func (s *timeshiftStore) cleanup(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	var segments []*timeshiftSegment
+	var size int64
+	for streamURL, ch := range s.channels {
+		if ch.idleSince(now) > s.idle {
+			ch.remove()
+			delete(s.channels, streamURL)
+			log.Printf("[iptv-proxy] Timeshift recording of an idle channel removed: %s", ch.dir)
+			continue
+		}
+
+		ch.expire(now.Add(-s.retention))
+		segments = append(segments, ch.closedSegments()...)
+		size += ch.size()
+	}
+
+	if s.quota <= 0 || size <= s.quota {
+		return
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	for _, segment := range segments {
+		if size <= s.quota {
+			break
+		}
+		for _, ch := range s.channels {
+			if ch.drop(segment) {
+				size -= segment.size
+				break
+			}
+		}
+	}
+}
+
+// timeshiftWrite is a chunk queued to be recorded
+type timeshiftWrite struct {
+	chunk *BufferChunk
+	// PAT and PMT of an MPEG-TS keyframe chunk, a segment can start on it
+	tables []byte
+	mpegts bool
+	// chunks were dropped before this one, it starts a new segment
+	resync bool
+}
+
+// timeshiftRecorder writes the chunks of a buffer to its recording in the background,
+// so the disk never slows down the buffer.
+type timeshiftRecorder struct {
+	ch    *timeshiftChannel
+	queue chan timeshiftWrite
+	// chunks are dropped up to the next segment start, protected by the buffer lock
+	skip    bool
+	dropped int64
+}
+
+// newRecorder starts recording a buffer until the recorder is stopped.
+func (ch *timeshiftChannel) newRecorder() *timeshiftRecorder {
+	r := &timeshiftRecorder{
+		ch:    ch,
+		queue: make(chan timeshiftWrite, timeshiftQueueSize),
+	}
+
+	go func() {
+		for w := range r.queue {
+			ch.record(w)
+		}
+		ch.stop()
+	}()
+
+	return r
+}
+
+// record queues a chunk of the stream, ts is the indexer of an MPEG-TS stream, nil for a raw one.
+// When the disk falls behind the chunks are dropped up to the next keyframe, the recording
+// resuming in a new segment.
+func (r *timeshiftRecorder) record(chunk *BufferChunk, ts *tsIndexer) {
+	cut := ts == nil || chunk.Keyframe
+	if r.skip && !cut {
+		r.dropped++
+		return
+	}
+
+	w := timeshiftWrite{chunk: chunk, mpegts: ts != nil, resync: r.skip}
+	if ts != nil && chunk.Keyframe {
+		w.tables = ts.tables()
+	}
+
+	select {
+	case r.queue <- w:
+		r.skip = false
+	default:
+		if !r.skip {
+			log.Printf("[iptv-proxy] WARNING: timeshift recording of %s falls behind, chunks dropped", r.ch.dir)
+		}
+		r.skip = true
+		r.dropped++
+	}
+}
+
+// stop ends the recording once the queued chunks are written, the caller no longer records.
+func (r *timeshiftRecorder) stop() {
+	close(r.queue)
+}
+
+// record appends a chunk of the stream.
+// A new segment starts on the first keyframe after timeshiftSegmentDuration.
+func (ch *timeshiftChannel) record(w timeshiftWrite) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	if ch.failed {
+		return
+	}
+
+	chunk := w.chunk
+	cut := !w.mpegts || chunk.Keyframe
+	current := ch.current()
+	if current == nil || w.resync || (cut && chunk.Timestamp.Sub(current.start) >= timeshiftSegmentDuration) {
+		if !cut {
+			// An MPEG-TS recording starts on a keyframe
+			return
+		}
+		if err := ch.rotate(chunk.Timestamp, w.tables); err != nil {
+			log.Printf("[iptv-proxy] WARNING: timeshift recording stopped: %v", err)
+			ch.failed = true
+			return
+		}
+		current = ch.current()
+	}
+
+	n, err := ch.file.Write(chunk.Data)
+	current.size += int64(n)
+	current.end = chunk.Timestamp
+	ch.lastWrite = chunk.Timestamp
+	if err != nil {
+		log.Printf("[iptv-proxy] WARNING: timeshift recording stopped: %v", err)
+		ch.failed = true
+		ch.close()
+	}
+}
+
+// rotate closes the current segment and opens a new one starting at start with the tables.
+func (ch *timeshiftChannel) rotate(start time.Time, tables []byte) error {
+	ch.close()
+
+	if err := os.MkdirAll(ch.dir, 0755); err != nil {
+		return err
+	}
+
+	segment := &timeshiftSegment{
+		id:    ch.nextID,
+		path:  filepath.Join(ch.dir, fmt.Sprintf("%d.ts", ch.nextID)),
+		start: start,
+		end:   start,
+	}
+	f, err := os.Create(segment.path)
+	if err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		n, err := f.Write(tables)
+		segment.size += int64(n)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	ch.file = f
+	ch.nextID++
+	ch.segments = append(ch.segments, segment)
+
+	select {
+	case ch.check <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// current returns the segment being written, nil if none.
+func (ch *timeshiftChannel) current() *timeshiftSegment {
+	if ch.file == nil {
+		return nil
+	}
+	return ch.segments[len(ch.segments)-1]
+}
+
+// close closes the segment being written.
+func (ch *timeshiftChannel) close() {
+	if ch.file != nil {
+		ch.file.Close() // nolint: errcheck
+		ch.file = nil
+	}
+}
+
+// stop ends the recording when the stream is no longer buffered, it resumes in a new segment.
+func (ch *timeshiftChannel) stop() {
+	ch.Lock()
+	defer ch.Unlock()
+
+	ch.close()
+	ch.lastWrite = time.Now()
+	ch.failed = false
+}
+
+// expire drops the segments ended before cutoff.
+func (ch *timeshiftChannel) expire(cutoff time.Time) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	for len(ch.segments) > 0 && ch.segments[0] != ch.current() && ch.segments[0].end.Before(cutoff) {
+		os.Remove(ch.segments[0].path) // nolint: errcheck
+		ch.segments = ch.segments[1:]
+	}
+}
+
+// drop removes a segment of the recording, false if it isn't one of its segments.
+func (ch *timeshiftChannel) drop(segment *timeshiftSegment) bool {
+	ch.Lock()
+	defer ch.Unlock()
+
+	for i, s := range ch.segments {
+		if s == segment && s != ch.current() {
+			os.Remove(s.path) // nolint: errcheck
+			ch.segments = append(ch.segments[:i], ch.segments[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes the whole recording.
+func (ch *timeshiftChannel) remove() {
+	ch.Lock()
+	defer ch.Unlock()
+
+	ch.close()
+	ch.segments = nil
+	os.RemoveAll(ch.dir) // nolint: errcheck
+}
+
+// closedSegments returns the segments no longer written.
+func (ch *timeshiftChannel) closedSegments() []*timeshiftSegment {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	segments := make([]*timeshiftSegment, 0, len(ch.segments))
+	for _, s := range ch.segments {
+		if s != ch.current() {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// size returns the bytes recorded on disk.
+func (ch *timeshiftChannel) size() int64 {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	var size int64
+	for _, s := range ch.segments {
+		size += s.size
+	}
+	return size
+}
+
+// idleSince returns how long the channel has not been recorded, zero while it is.
+func (ch *timeshiftChannel) idleSince(now time.Time) time.Duration {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	if ch.file != nil || ch.lastWrite.IsZero() {
+		return 0
+	}
+	return now.Sub(ch.lastWrite)
+}
+
+// empty reports whether nothing is recorded.
+func (ch *timeshiftChannel) empty() bool {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return len(ch.segments) == 0
+}
+
+// covers reports whether the recording starts before start, the xtream start times being rounded to the minute.
+func (ch *timeshiftChannel) covers(start time.Time) bool {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return len(ch.segments) > 0 && !start.Before(ch.segments[0].start.Truncate(time.Minute))
+}
+
+// segment returns the first segment from id.
+func (ch *timeshiftChannel) segment(id int64) *timeshiftSegment {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	for _, s := range ch.segments {
+		if s.id >= id {
+			return s
+		}
+	}
+	return nil
+}
+
+// writing reports whether the segment id is being written.
+func (ch *timeshiftChannel) writing(id int64) bool {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	current := ch.current()
+	return current != nil && current.id == id
+}
+
+// recording reports whether the stream is being recorded.
+func (ch *timeshiftChannel) recording() bool {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	return ch.file != nil
+}
+
+// timeshiftReader plays a recording from a start time up to the live edge.
+type timeshiftReader struct {
+	ctx  context.Context
+	ch   *timeshiftChannel
+	id   int64
+	file *os.File
+}
+
+// newReader returns a reader starting at the segment the closest before start, at the oldest one if none.
+func (ch *timeshiftChannel) newReader(ctx context.Context, start time.Time) *timeshiftReader {
+	ch.RLock()
+	defer ch.RUnlock()
+
+	r := &timeshiftReader{ctx: ctx, ch: ch}
+	for _, s := range ch.segments {
+		if s.start.After(start) {
+			break
+		}
+		r.id = s.id
+	}
+	if len(ch.segments) > 0 && r.id < ch.segments[0].id {
+		r.id = ch.segments[0].id
+	}
+
+	return r
+}
+
+// Read reads the segments in order, waiting for the data of the segment being written.
+// io.EOF is returned once the recording is over or the context is done.
+func (r *timeshiftReader) Read(p []byte) (int, error) {
+	for r.ctx.Err() == nil {
+		if r.file == nil {
+			segment := r.ch.segment(r.id)
+			if segment == nil {
+				if !r.ch.recording() {
+					return 0, io.EOF
+				}
+				r.wait()
+				continue
+			}
+
+			f, err := os.Open(segment.path)
+			if err != nil {
+				// Dropped by the retention or the quota
+				r.id = segment.id + 1
+				continue
+			}
+			r.file, r.id = f, segment.id
+		}
+
+		// The segment is complete once read to its end after it is no longer written
+		writing := r.ch.writing(r.id)
+		n, err := r.file.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if writing {
+			r.wait()
+			continue
+		}
+
+		r.file.Close() // nolint: errcheck
+		r.file = nil
+		r.id++
+	}
+
+	return 0, io.EOF
+}
+
+func (r *timeshiftReader) wait() {
+	select {
+	case <-r.ctx.Done():
+	case <-time.After(timeshiftPollInterval):
+	}
+}
+
+// Close closes the segment being read.
+func (r *timeshiftReader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
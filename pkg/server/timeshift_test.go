@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/jamesnetherton/m3u"
+)
+
+func TestTimeshiftStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The recordings of a previous run are removed, not the other files of the folder
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(dir, "0123456789abcdef")
+	if err := os.Mkdir(previous, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newTimeshiftStore(&config.ProxyConfig{
+		TimeshiftRetention: 2 * time.Hour,
+		TimeshiftIdle:      time.Minute,
+		TimeshiftDir:       dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Expected the other files of the folder to be kept: %v", err)
+	}
+	if _, err := os.Stat(previous); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous recording to be removed: %v", err)
+	}
+
+	const streamURL = "http://example.com/live/user/pass/1.ts"
+	if store.lookup(streamURL) != nil {
+		t.Fatal("Expected no recording before the stream is buffered")
+	}
+
+	ts := newTSIndexer()
+	ts.inspect(testPAT())
+	ts.inspect(testPMT())
+	tables := append(testPAT(), testPMT()...)
+
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Minute).Add(30 * time.Second)
+	ch := store.channel(streamURL)
+	record := func(offset time.Duration, keyframe bool, data []byte) {
+		w := timeshiftWrite{chunk: &BufferChunk{Data: data, Size: len(data), Timestamp: t0.Add(offset), Keyframe: keyframe}, mpegts: true}
+		if keyframe {
+			w.tables = ts.tables()
+		}
+		ch.record(w)
+	}
+	record(0, false, testVideoData())
+	record(time.Second, true, testVideoPES(true))
+	record(5*time.Second, false, testVideoData())
+	record(8*time.Second, true, testVideoPES(true))
+	record(12*time.Second, true, testVideoPES(true))
+	record(13*time.Second, false, testVideoData())
+
+	// Cut on the first keyframe after the segment duration, each segment starting with the tables
+	first := append(append(append([]byte{}, tables...), testVideoPES(true)...), testVideoData()...)
+	first = append(first, testVideoPES(true)...)
+	second := append(append(append([]byte{}, tables...), testVideoPES(true)...), testVideoData()...)
+	if len(ch.segments) != 2 || !ch.segments[0].start.Equal(t0.Add(time.Second)) || !ch.segments[1].start.Equal(t0.Add(12*time.Second)) {
+		t.Fatalf("Unexpected segments %+v", ch.segments)
+	}
+	if data, err := ioutil.ReadFile(ch.segments[0].path); err != nil || !bytes.Equal(data, first) {
+		t.Errorf("Unexpected first segment of %d bytes: %v", len(data), err)
+	}
+
+	if store.lookup(streamURL) != ch || !ch.covers(t0) || ch.covers(t0.Add(-time.Minute)) {
+		t.Error("Expected the recording to cover its first minute")
+	}
+
+	// The reader follows the segment being written until the recording stops
+	defer func(interval time.Duration) { timeshiftPollInterval = interval }(timeshiftPollInterval)
+	timeshiftPollInterval = 10 * time.Millisecond
+	reader := ch.newReader(context.Background(), t0.Add(15*time.Second))
+	defer reader.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		record(14*time.Second, false, testVideoData())
+		ch.stop()
+	}()
+	if data, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, append(second, testVideoData()...)) {
+		t.Errorf("Expected the second segment and the live data, got %d bytes: %v", len(data), err)
+	}
+
+	from := ch.newReader(context.Background(), t0)
+	defer from.Close()
+	if data, err := ioutil.ReadAll(from); err != nil || len(data) != len(first)+len(second)+len(testVideoData()) {
+		t.Errorf("Expected the whole recording, got %d bytes: %v", len(data), err)
+	}
+
+	// The quota drops the oldest segments
+	store.quota = ch.segments[1].size
+	store.cleanup(time.Now())
+	if len(ch.segments) != 1 || ch.segments[0].id != 1 {
+		t.Errorf("Expected the first segment to be dropped over the quota, got %+v", ch.segments)
+	}
+
+	// The retention drops the segments ended before it
+	store.quota = 0
+	store.retention = 30 * time.Minute
+	store.cleanup(time.Now())
+	if store.lookup(streamURL) != nil {
+		t.Error("Expected the recording to expire")
+	}
+
+	// The recording of an idle channel is removed
+	store.cleanup(time.Now().Add(2 * time.Minute))
+	if _, ok := store.channels[streamURL]; ok {
+		t.Error("Expected the idle channel to be removed")
+	}
+	if _, err := os.Stat(ch.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the recording folder to be removed: %v", err)
+	}
+}
+
+func TestStreamBufferTimeshift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newTimeshiftStore(&config.ProxyConfig{TimeshiftRetention: time.Hour, TimeshiftIdle: time.Minute, TimeshiftDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := NewStreamBuffer(time.Second)
+	sb.recorder = store.channel("http://example.com/live/1.ts").newRecorder()
+
+	stream := append(testVideoData(), testPAT()...)
+	stream = append(stream, testPMT()...)
+	stream = append(stream, testVideoPES(true)...)
+	stream = append(stream, testVideoData()...)
+	writeInPieces(t, sb, stream, 100)
+	sb.Close()
+
+	// The queued chunks are written in the background
+	recording := store.channel("http://example.com/live/1.ts")
+	for deadline := time.Now().Add(time.Second); recording.recording() || recording.empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a recording stopped with the buffer")
+		}
+	}
+	want := append(append(testPAT(), testPMT()...), testVideoPES(true)...)
+	want = append(want, testVideoData()...)
+	if data, err := ioutil.ReadAll(recording.newReader(context.Background(), time.Now())); err != nil || !bytes.Equal(data, want) {
+		t.Errorf("Expected the stream recorded from its keyframe, got %d bytes: %v", len(data), err)
+	}
+}
+
+func TestTimeshiftRecorderFallsBehind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newTimeshiftStore(&config.ProxyConfig{TimeshiftRetention: time.Hour, TimeshiftIdle: time.Minute, TimeshiftDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A recorder whose disk is blocked
+	ch := store.channel("http://example.com/live/1.ts")
+	r := &timeshiftRecorder{ch: ch, queue: make(chan timeshiftWrite, 2)}
+
+	ts := newTSIndexer()
+	ts.inspect(testPAT())
+	ts.inspect(testPMT())
+	t0 := time.Now()
+	record := func(offset time.Duration, keyframe bool, data []byte) {
+		r.record(&BufferChunk{Data: data, Size: len(data), Timestamp: t0.Add(offset), Keyframe: keyframe}, ts)
+	}
+	record(0, true, testVideoPES(true))
+	record(time.Second, false, testVideoData())
+	record(2*time.Second, false, testVideoData())
+	record(3*time.Second, false, testVideoData())
+	if !r.skip || r.dropped != 2 {
+		t.Fatalf("Expected the chunks over the queue to be dropped, got %d", r.dropped)
+	}
+
+	// Once the disk catches up, the recording resumes on a keyframe in a new segment
+	<-r.queue
+	<-r.queue
+	record(4*time.Second, true, testVideoPES(true))
+	if r.skip || r.dropped != 2 || len(r.queue) != 1 {
+		t.Fatalf("Expected the recording to resume on the keyframe, got %d dropped", r.dropped)
+	}
+	w := <-r.queue
+	if !w.resync || !bytes.Equal(w.tables, append(testPAT(), testPMT()...)) {
+		t.Errorf("Expected the keyframe to start a new segment with the tables, got %+v", w)
+	}
+}
+
+func TestM3UTrackTimeshift(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(append(testPAT(), testPMT()...)) // nolint: errcheck
+		for {
+			w.Write(testVideoPES(true)) // nolint: errcheck
+			w.(http.Flusher).Flush()
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	store, err := newTimeshiftStore(&config.ProxyConfig{TimeshiftRetention: time.Hour, TimeshiftIdle: time.Minute, TimeshiftDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := GetBufferManager()
+	manager.SetBufferDuration(50 * time.Millisecond)
+	defer manager.SetBufferDuration(DefaultBufferDuration)
+	manager.setTimeshift(store)
+	defer manager.setTimeshift(nil)
+
+	// A playlist track served as .ts, never buffered without timeshift
+	streamURL := upstream.URL + "/channel.ts"
+	track := &m3u.Track{Name: "BBC One", URI: streamURL}
+	account := &config.Account{Username: "test"}
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{BufferEnabled: true},
+		users:       newUserStore([]config.Account{*account}),
+		timeshift:   store,
+	}
+	router := gin.New()
+	router.GET("/track", func(ctx *gin.Context) {
+		ctx.Set(accountKey, account)
+		c.serveTrack(ctx, track)
+	})
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+	defer manager.RemoveBuffer(streamURL)
+
+	resp, err := http.Get(proxy.URL + "/track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, tsPacketSize)
+	if _, err := resp.Body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); store.lookup(streamURL) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the playlist track to be recorded")
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HTTPModeRedirect redirects the plain HTTP requests to HTTPS
+	HTTPModeRedirect = "redirect"
+	// HTTPModeStreams serves only the stream endpoints in plain HTTP
+	HTTPModeStreams = "streams"
+)
+
+// tlsCheckInterval is how often the certificate files are checked for a renewal
+var tlsCheckInterval = 30 * time.Second
+
+// certificateReloader serves a TLS certificate, reloaded when its files change on disk
+type certificateReloader struct {
+	certFile, keyFile string
+
+	mutex sync.Mutex
+	cert  *tls.Certificate
+	// modification times of the loaded files, only used by the watcher
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload loads the certificate if its files changed
+func (r *certificateReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if !r.certMod.IsZero() && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if !r.certMod.IsZero() {
+		log.Printf("[iptv-proxy] TLS certificate reloaded from %s", r.certFile)
+	}
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// watch checks the certificate files every tlsCheckInterval until done is closed.
+func (r *certificateReloader) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(tlsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// Keep serving the previous certificate while a renewal is half written
+		if err := r.reload(); err != nil {
+			log.Printf("[iptv-proxy] WARNING: unable to reload TLS certificate: %v", err)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, to be used in tls.Config
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.cert, nil
+}
+
+// servers returns the http servers to start, the TLS one and the optional plain HTTP one
+func (c *Config) servers() ([]*http.Server, error) {
+	router := gin.Default()
+	router.Use(cors.Default())
+	c.routes(router.Group("/"))
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.HostConfig.Port),
+		Handler: router,
+	}
+	if c.TLSCert == "" {
+		return []*http.Server{server}, nil
+	}
+
+	reloader, err := newCertificateReloader(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	go reloader.watch(c.done)
+
+	if c.HTTPPort == 0 {
+		return []*http.Server{server}, nil
+	}
+
+	var handler http.Handler
+	switch c.HTTPMode {
+	case HTTPModeStreams:
+		streams := gin.Default()
+		streams.Use(cors.Default())
+		c.streamRoutes(streams.Group("/"))
+		handler = streams
+	case HTTPModeRedirect, "":
+		handler = http.HandlerFunc(c.redirectToHTTPS)
+	default:
+		return nil, fmt.Errorf("unknown http mode %q", c.HTTPMode)
+	}
+
+	plain := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.HTTPPort),
+		Handler: handler,
+	}
+
+	return []*http.Server{server, plain}, nil
+}
+
+// listen starts the server, in TLS if it has a TLS configuration
+func listen(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the TLS listener
+func (c *Config) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if c.AdvertisedPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.AdvertisedPort))
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
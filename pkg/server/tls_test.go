@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Errorf("Expected first certificate, got %q", name)
+	}
+
+	// A renewal, with modification times guaranteed to change
+	writeTestCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later) // nolint: errcheck
+	os.Chtimes(keyFile, later, later)  // nolint: errcheck
+	if name := commonName(); name != "first" {
+		t.Errorf("Expected the certificate to be reloaded by the watcher only, got %q", name)
+	}
+
+	defer func(interval time.Duration) { tlsCheckInterval = interval }(tlsCheckInterval)
+	tlsCheckInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	defer close(done)
+	go reloader.watch(done)
+	time.Sleep(100 * time.Millisecond)
+	if name := commonName(); name != "second" {
+		t.Errorf("Expected renewed certificate, got %q", name)
+	}
+
+	// A broken renewal keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600) // nolint: errcheck
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later) // nolint: errcheck
+	time.Sleep(100 * time.Millisecond)
+	if name := commonName(); name != "second" {
+		t.Errorf("Expected previous certificate to be kept, got %q", name)
+	}
+}
+
+func TestPlainHTTPListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "proxy")
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+`)
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.TLSCert = certFile
+	serverConfig.TLSKey = keyFile
+	serverConfig.HTTPPort = 8081
+	serverConfig.AdvertisedPort = 8443
+
+	t.Run("Redirect", func(t *testing.T) {
+		servers, err := serverConfig.servers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(servers) != 2 || servers[0].TLSConfig == nil || servers[1].TLSConfig != nil {
+			t.Fatalf("Expected a TLS and a plain HTTP server, got %d servers", len(servers))
+		}
+
+		w := httptest.NewRecorder()
+		servers[1].Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.lan:8081/iptv.m3u?username=test&password=test", nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://proxy.lan:8443/iptv.m3u?username=test&password=test" {
+			t.Errorf("Unexpected redirect %d to %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Streams only", func(t *testing.T) {
+		serverConfig.HTTPMode = HTTPModeStreams
+		servers, err := serverConfig.servers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		servers[1].Handler.ServeHTTP(w, httptest.NewRequest("GET", "/iptv.m3u?username=test&password=test", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected the playlist not to be served in plain HTTP, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		servers[1].Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+serverConfig.endpointAntiColision+"/test/wrong/abc/one.ts", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the stream route to be served in plain HTTP, got %d", w.Code)
+		}
+	})
+}
+
+func TestTLSImpliesHTTPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "proxy")
+
+	newConfig := func() *config.ProxyConfig {
+		return &config.ProxyConfig{
+			HostConfig:     &config.HostConfiguration{Hostname: "proxy.lan", Port: 8443},
+			RemoteURL:      &url.URL{},
+			User:           "test",
+			Password:       "test",
+			AdvertisedPort: 8443,
+			TLSCert:        certFile,
+		}
+	}
+
+	if _, err := NewServer(newConfig()); err == nil {
+		t.Error("Expected a certificate without its key to be rejected")
+	}
+
+	proxyConfig := newConfig()
+	proxyConfig.TLSKey = keyFile
+	serverConfig, err := NewServer(proxyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverConfig.HTTPS || serverConfig.baseURL() != "https://proxy.lan:8443" {
+		t.Errorf("Expected the proxy urls in https, got %s", serverConfig.baseURL())
+	}
+}
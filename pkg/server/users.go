@@ -0,0 +1,148 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+const accountKey = "iptv-proxy-account"
+
+// userStore holds the proxy accounts and their active streams.
+type userStore struct {
+	sync.Mutex
+	accounts map[string]*config.Account
+	active   map[string]int
+}
+
+// proxyAccounts returns the accounts of the users file,
+// or the account of the user and password flags.
+func proxyAccounts(proxyConfig *config.ProxyConfig) ([]config.Account, error) {
+	if proxyConfig.UsersFile == "" {
+		return []config.Account{{Username: proxyConfig.User, Password: proxyConfig.Password}}, nil
+	}
+
+	accounts, err := config.LoadAccounts(proxyConfig.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[iptv-proxy] %d users loaded from %s", len(accounts), proxyConfig.UsersFile)
+
+	return accounts, nil
+}
+
+func newUserStore(accounts []config.Account) *userStore {
+	s := &userStore{
+		accounts: make(map[string]*config.Account, len(accounts)),
+		active:   make(map[string]int, len(accounts)),
+	}
+
+	for i := range accounts {
+		s.accounts[accounts[i].Username.String()] = &accounts[i]
+	}
+
+	return s
+}
+
+// get returns the account of username.
+func (s *userStore) get(username string) (*config.Account, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	a, ok := s.accounts[username]
+	return a, ok
+}
+
+// authenticate returns the account matching the credentials.
+func (s *userStore) authenticate(username, password string) (*config.Account, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	a, ok := s.accounts[username]
+	if !ok || a.Password.String() != password || a.Expired() {
+		return nil, false
+	}
+
+	return a, true
+}
+
+// list returns the accounts sorted by username.
+func (s *userStore) list() []*config.Account {
+	s.Lock()
+	defer s.Unlock()
+
+	accounts := make([]*config.Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Username < accounts[j].Username
+	})
+
+	return accounts
+}
+
+// acquire registers a new stream for the account,
+// it returns false if the account reached its maximum connections.
+func (s *userStore) acquire(a *config.Account) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	username := a.Username.String()
+	if a.MaxConnections > 0 && s.active[username] >= a.MaxConnections {
+		return false
+	}
+	s.active[username]++
+
+	return true
+}
+
+// release unregisters a stream of the account.
+func (s *userStore) release(a *config.Account) {
+	s.Lock()
+	defer s.Unlock()
+
+	username := a.Username.String()
+	if s.active[username] > 0 {
+		s.active[username]--
+	}
+}
+
+// activeConnections returns the number of streams of the account.
+func (s *userStore) activeConnections(a *config.Account) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.active[a.Username.String()]
+}
+
+// accountFrom returns the account authenticated for the request, if any.
+func accountFrom(ctx *gin.Context) *config.Account {
+	v, ok := ctx.Get(accountKey)
+	if !ok {
+		return nil
+	}
+
+	return v.(*config.Account)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+)
+
+func TestUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usersPath := filepath.Join(dir, "users.yaml")
+	writePlaylist(t, usersPath, `users:
+  - username: alice
+    password: secret
+    allowed-groups: [News]
+    max-connections: 1
+  - username: bob
+    password: secret
+    exp-date: 2000-01-01
+`)
+
+	accounts, err := proxyAccounts(&config.ProxyConfig{UsersFile: usersPath})
+	if err != nil {
+		t.Fatalf("Failed to load users: %v", err)
+	}
+	users := newUserStore(accounts)
+
+	alice, ok := users.authenticate("alice", "secret")
+	if !ok {
+		t.Fatal("Expected alice to be authenticated")
+	}
+	if _, ok := users.authenticate("alice", "wrong"); ok {
+		t.Error("Expected a wrong password to be rejected")
+	}
+	if _, ok := users.authenticate("bob", "secret"); ok {
+		t.Error("Expected an expired account to be rejected")
+	}
+
+	emptyPath := filepath.Join(dir, "empty.yaml")
+	writePlaylist(t, emptyPath, "users: []\n")
+	if _, err := proxyAccounts(&config.ProxyConfig{UsersFile: emptyPath}); err == nil {
+		t.Error("Expected a users file without users to be rejected")
+	}
+	duplicatePath := filepath.Join(dir, "duplicate.yaml")
+	writePlaylist(t, duplicatePath, "users:\n  - {username: alice, password: one}\n  - {username: alice, password: two}\n")
+	if _, err := proxyAccounts(&config.ProxyConfig{UsersFile: duplicatePath}); err == nil || !strings.Contains(err.Error(), `"alice"`) {
+		t.Errorf("Expected the duplicate user to be named, got %v", err)
+	}
+	if _, err := (&Config{ProxyConfig: &config.ProxyConfig{}, users: newUserStore(nil)}).hdhrAccount(); err == nil {
+		t.Error("Expected no HDHomeRun account without users")
+	}
+	if _, err := (&Config{ProxyConfig: &config.ProxyConfig{}, users: users}).hdhrAccount(); err == nil {
+		t.Error("Expected no HDHomeRun account picked without --hdhr-user")
+	}
+
+	if !alice.AllowGroup("news") || alice.AllowGroup("Sports") {
+		t.Errorf("Unexpected group entitlements for alice: %v", alice.AllowedGroups)
+	}
+
+	if !users.acquire(alice) {
+		t.Fatal("Expected alice first stream to be accepted")
+	}
+	if users.acquire(alice) {
+		t.Error("Expected alice second stream to be refused")
+	}
+	users.release(alice)
+	if users.activeConnections(alice) != 0 {
+		t.Errorf("Expected no active connection, got %d", users.activeConnections(alice))
+	}
+}
+
+func TestUserPlaylists(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+#EXTINF:-1 tvg-id="two" group-title="Sports",Channel Two
+http://example.com/two.ts
+`)
+	usersPath := filepath.Join(dir, "users.yaml")
+	writePlaylist(t, usersPath, `users:
+  - username: alice
+    password: secret
+    allowed-groups: [News]
+  - username: bob
+    password: other
+`)
+
+	remoteURL, _ := url.Parse(playlistPath)
+	serverConfig, err := NewServer(&config.ProxyConfig{
+		HostConfig: &config.HostConfiguration{
+			Hostname: "localhost",
+			Port:     8080,
+		},
+		RemoteURL:      remoteURL,
+		UsersFile:      usersPath,
+		M3UFileName:    "iptv.m3u",
+		AdvertisedPort: 8080,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	serverConfig.proxyfiedM3UPath = filepath.Join(dir, "proxyfied.m3u")
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/iptv.m3u?username=alice&password=secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected alice playlist, got status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "/alice/secret/") || strings.Contains(body, "Channel Two") {
+		t.Errorf("Unexpected alice playlist:\n%s", body)
+	}
+
+	if w := get("/iptv.m3u?username=alice&password=other"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected bad credentials to be refused, got status %d", w.Code)
+	}
+
+	sportsID := trackIDs(serverConfig.playlist.Tracks)[1]
+	if w := get("/" + serverConfig.endpointAntiColision + "/alice/secret/" + sportsID + "/two.ts"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected alice to be forbidden on sports, got status %d", w.Code)
+	}
+	if w := get("/" + serverConfig.endpointAntiColision + "/carol/secret/" + sportsID + "/two.ts"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unknown user to be refused, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,457 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+	"github.com/jamesnetherton/m3u"
+)
+
+// xmltvSource returns the XMLTV guide of the provider, or the one configured for the m3u playlist.
+func (c *Config) xmltvSource() string {
+	if c.XtreamBaseURL != "" {
+		return c.xtreamXMLTVURL()
+	}
+
+	return c.XMLTVURL
+}
+
+// xmltvFiltered reports whether the guide is trimmed to the playlist channels or to a time window,
+// or shifted by the rules.
+func (c *Config) xmltvFiltered() bool {
+	return c.XMLTVFilter || c.XMLTVPastDays > 0 || c.XMLTVFutureDays > 0 || c.rules.HasEPGOffsets()
+}
+
+// serveXMLTV serves xmltv.php, from the cached copy of the guide when there is one.
+func (c *Config) serveXMLTV(ctx *gin.Context) {
+	var err error
+	switch {
+	case c.xmltvFiltered():
+		err = c.filterXMLTV(ctx)
+	case c.xmltv != nil && c.xmltv.ready():
+		err = c.xmltv.serve(ctx)
+	default:
+		var rc io.ReadCloser
+		if rc, err = c.openXMLTVGuide(ctx); err == nil {
+			defer rc.Close()
+			err = streamXMLTV(ctx, rc)
+		}
+	}
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+}
+
+// openXMLTVGuide opens the served guide, the cached copy when there is one.
+func (c *Config) openXMLTVGuide(ctx *gin.Context) (io.ReadCloser, error) {
+	if c.xmltv == nil {
+		return openXMLTV(ctx.Request.Context(), c.xmltvSource(), ctx.Request.UserAgent())
+	}
+	if c.xmltv.ready() {
+		return c.xmltv.open()
+	}
+
+	return c.xmltv.fetch(ctx.Request.Context(), ctx.Request.UserAgent())
+}
+
+// filterXMLTV streams the guide keeping only the channels of the account playlist
+// and the programmes of the configured days, shifted by the offset of their channel.
+func (c *Config) filterXMLTV(ctx *gin.Context) error {
+	opts := xmltv.FilterOptions{}
+	if c.XMLTVFilter {
+		channels, err := c.xmltvChannels(ctx)
+		if err != nil {
+			return err
+		}
+		opts.Channel = func(id string) bool { return channels[id] }
+	}
+
+	offsets, err := c.channelEPGOffsets(ctx)
+	if err != nil {
+		return err
+	}
+	if len(offsets) > 0 {
+		opts.Offset = func(channel string) time.Duration { return offsets[channel] }
+	}
+
+	now := time.Now()
+	if c.XMLTVPastDays > 0 {
+		opts.From = now.AddDate(0, 0, -c.XMLTVPastDays)
+	}
+	if c.XMLTVFutureDays > 0 {
+		opts.To = now.AddDate(0, 0, c.XMLTVFutureDays)
+	}
+
+	rc, err := c.openXMLTVGuide(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	ctx.Header("Content-Type", "application/xml")
+	ctx.Header("Vary", "Accept-Encoding")
+
+	var w io.Writer = ctx.Writer
+	if acceptsGzip(ctx.Request) {
+		ctx.Header("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(ctx.Writer)
+		defer gz.Close()
+		w = gz
+	}
+	ctx.Status(http.StatusOK)
+
+	if err := xmltv.Filter(w, rc, opts); err != nil {
+		// The response is already started, the guide is truncated
+		log.Printf("[iptv-proxy] WARNING: unable to filter the xmltv guide: %v", err)
+	}
+
+	return nil
+}
+
+// xmltvChannels returns the tvg-ids of the channels the account can access, from the playlist
+// or the xtream live streams, after the rules.
+func (c *Config) xmltvChannels(ctx *gin.Context) (map[string]bool, error) {
+	account := accountFrom(ctx)
+
+	var tracks []m3u.Track
+	if c.XtreamBaseURL != "" {
+		client, err := c.xtreamClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if tracks, err = c.xtreamLiveTracks(client, ""); err != nil {
+			return nil, err
+		}
+		tracks = c.rules.Apply(tracks)
+	} else {
+		tracks, _, _ = c.tracks.snapshot()
+	}
+
+	channels := make(map[string]bool, len(tracks))
+	for _, track := range tracks {
+		if id := rules.Tag(track, "tvg-id"); id != "" && account.AllowGroup(rules.Tag(track, "group-title")) {
+			channels[id] = true
+		}
+	}
+
+	return channels, nil
+}
+
+// xmltvCache is the copy on disk of an XMLTV guide, stored as sent by the upstream,
+// gzip compressed or not, and refreshed in the background.
+type xmltvCache struct {
+	sync.RWMutex
+	// fetch opens the guide to cache
+	fetch   func(ctx context.Context, userAgent string) (io.ReadCloser, error)
+	path    string
+	refresh time.Duration
+	gzipped bool
+	modTime time.Time
+	size    int64
+}
+
+func newXMLTVCache(source string, refresh time.Duration) *xmltvCache {
+	h := sha1.Sum([]byte(source))
+	x := &xmltvCache{
+		fetch: func(ctx context.Context, userAgent string) (io.ReadCloser, error) {
+			return openXMLTV(ctx, source, userAgent)
+		},
+		path:    filepath.Join(xmltvCacheDir(), "iptv-proxy-"+hex.EncodeToString(h[:])[:12]+".xmltv"),
+		refresh: refresh,
+	}
+
+	// Reuse the guide cached by a previous run
+	if err := x.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("[iptv-proxy] WARNING: unable to read the cached xmltv guide: %v", err)
+	}
+
+	return x
+}
+
+// xmltvCacheDir returns the folder of the cached guides.
+func xmltvCacheDir() string {
+	if config.CacheFolder != "" {
+		return config.CacheFolder
+	}
+
+	return os.TempDir()
+}
+
+// load reads the state of the cached file.
+func (x *xmltvCache) load() error {
+	f, err := os.Open(x.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(f, magic)
+
+	x.Lock()
+	x.gzipped = isGzip(magic[:n])
+	x.modTime = info.ModTime()
+	x.size = info.Size()
+	x.Unlock()
+
+	return nil
+}
+
+// ready reports whether the guide is cached.
+func (x *xmltvCache) ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+
+	return !x.modTime.IsZero()
+}
+
+// version returns the modification time of the cached guide, zero if it isn't cached yet.
+func (x *xmltvCache) version() time.Time {
+	x.RLock()
+	defer x.RUnlock()
+
+	return x.modTime
+}
+
+// stale reports whether the cached guide must be refreshed.
+func (x *xmltvCache) stale() bool {
+	x.RLock()
+	defer x.RUnlock()
+
+	return x.modTime.IsZero() || time.Since(x.modTime) >= x.refresh
+}
+
+// etag is derived from the file modification time and size, like most file servers do.
+func (x *xmltvCache) etag() string {
+	return fmt.Sprintf(`"%x-%x"`, x.modTime.UnixNano(), x.size)
+}
+
+// update downloads the guide into a temporary file and moves it over the cached one,
+// the requests being served keep reading the previous file.
+func (x *xmltvCache) update(ctx context.Context) error {
+	rc, err := x.fetch(ctx, "")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	body := bufio.NewReader(rc)
+	magic, _ := body.Peek(2)
+	gzipped := isGzip(magic)
+
+	tmpPath := x.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(tmpPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	if err := os.Rename(tmpPath, x.path); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+	x.gzipped = gzipped
+	x.modTime = info.ModTime()
+	x.size = info.Size()
+
+	return nil
+}
+
+// refresher keeps the cached guide fresh until done is closed.
+func (x *xmltvCache) refresher(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if x.stale() {
+			start := time.Now()
+			if err := x.update(context.Background()); err != nil {
+				log.Printf("[iptv-proxy] WARNING: unable to refresh the xmltv guide: %v", err)
+			} else {
+				log.Printf("[iptv-proxy] XMLTV guide cached in %v", time.Since(start).Round(time.Millisecond))
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serve writes the cached guide, the conditional and range requests are handled by http.ServeContent.
+func (x *xmltvCache) serve(ctx *gin.Context) error {
+	x.RLock()
+	f, err := os.Open(x.path)
+	gzipped, modTime, etag := x.gzipped, x.modTime, x.etag()
+	x.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx.Header("Content-Type", "application/xml")
+	ctx.Header("Vary", "Accept-Encoding")
+
+	if !gzipped || acceptsGzip(ctx.Request) {
+		ctx.Header("ETag", etag)
+		if gzipped {
+			ctx.Header("Content-Encoding", "gzip")
+		}
+		http.ServeContent(ctx.Writer, ctx.Request, "", modTime, f)
+		return nil
+	}
+
+	// The client doesn't accept gzip, the guide is decompressed on the fly
+	etag = strings.TrimSuffix(etag, `"`) + `-identity"`
+	ctx.Header("ETag", etag)
+	ctx.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if ctx.GetHeader("If-None-Match") == etag {
+		ctx.Status(http.StatusNotModified)
+		return nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	ctx.Status(http.StatusOK)
+	io.Copy(ctx.Writer, gz) // nolint: errcheck
+
+	return nil
+}
+
+// open returns the cached guide, as sent by the upstream.
+func (x *xmltvCache) open() (io.ReadCloser, error) {
+	x.RLock()
+	defer x.RUnlock()
+
+	return os.Open(x.path)
+}
+
+// openXMLTV opens an XMLTV guide, an url or a file. The transport is not let
+// decompress the guide, so a gzip body can be passed through as is.
+func openXMLTV(ctx context.Context, source, userAgent string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("xmltv upstream returned status %d", resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// streamXMLTV pipes the upstream guide to the client, gzip compressed if both sides support it.
+func streamXMLTV(ctx *gin.Context, rc io.Reader) error {
+	body := bufio.NewReader(rc)
+	magic, _ := body.Peek(2)
+
+	var r io.Reader = body
+	if isGzip(magic) {
+		if acceptsGzip(ctx.Request) {
+			ctx.Header("Content-Encoding", "gzip")
+		} else {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+	}
+
+	ctx.Header("Content-Type", "application/xml")
+	ctx.Header("Vary", "Accept-Encoding")
+	ctx.Status(http.StatusOK)
+	io.Copy(ctx.Writer, r) // nolint: errcheck
+
+	return nil
+}
+
+func isGzip(magic []byte) bool {
+	return len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
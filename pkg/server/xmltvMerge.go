@@ -0,0 +1,157 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+)
+
+// xmltvMergeSource is a guide merged into the served one.
+type xmltvMergeSource struct {
+	config.XMLTVSource
+	// name of the source in the logs, the provider url holds the credentials
+	name string
+	// cached copy of a remote guide, nil for a file
+	cache *xmltvCache
+}
+
+// open returns the guide of the source. A remote guide is refreshed when stale,
+// its previous copy is kept if the upstream fails.
+func (s *xmltvMergeSource) open(ctx context.Context) (io.ReadCloser, error) {
+	if s.cache == nil {
+		return openXMLTV(ctx, s.URL, "")
+	}
+
+	if s.cache.stale() {
+		if err := s.cache.update(ctx); err != nil {
+			log.Printf("[iptv-proxy] WARNING: unable to refresh the xmltv source %s: %v", s.name, err)
+		}
+	}
+	if !s.cache.ready() {
+		return nil, fmt.Errorf("xmltv source %s not available", s.name)
+	}
+
+	return s.cache.open()
+}
+
+// xmltvMergeSources returns the sources of the merged guide by precedence: the highest
+// priority first, the guide of the provider or of --xmltv-url having the priority 0
+// and coming before the other sources of the same priority.
+func (c *Config) xmltvMergeSources() []*xmltvMergeSource {
+	sources := make([]*xmltvMergeSource, 0, len(c.XMLTVSources)+1)
+	if primary := c.xmltvSource(); primary != "" {
+		sources = append(sources, &xmltvMergeSource{
+			XMLTVSource: config.XMLTVSource{URL: primary},
+			name:        "main guide",
+		})
+	}
+	for _, src := range c.XMLTVSources {
+		sources = append(sources, &xmltvMergeSource{XMLTVSource: src, name: src.URL})
+	}
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Priority > sources[j].Priority
+	})
+
+	for _, src := range sources {
+		if strings.HasPrefix(src.URL, "http://") || strings.HasPrefix(src.URL, "https://") {
+			src.cache = newXMLTVCache(src.URL, c.XMLTVCacheRefresh)
+		}
+	}
+
+	return sources
+}
+
+// newMergedXMLTVCache returns the cache of the guide merged from all the XMLTV sources.
+func (c *Config) newMergedXMLTVCache() *xmltvCache {
+	sources := c.xmltvMergeSources()
+
+	key := make([]string, 0, len(sources))
+	for _, src := range sources {
+		key = append(key, fmt.Sprintf("%s|%d|%v", src.URL, src.Priority, src.Aliases))
+	}
+
+	x := newXMLTVCache("merge:"+strings.Join(key, "\n"), c.XMLTVCacheRefresh)
+	x.fetch = func(ctx context.Context, _ string) (io.ReadCloser, error) {
+		return mergeXMLTV(ctx, sources)
+	}
+
+	return x
+}
+
+// mergeXMLTV opens the sources and returns their merged guide, the unavailable sources are skipped.
+func mergeXMLTV(ctx context.Context, sources []*xmltvMergeSource) (io.ReadCloser, error) {
+	merged := make([]xmltv.Source, 0, len(sources))
+	closers := make([]io.Closer, 0, len(sources))
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close() // nolint: errcheck
+		}
+	}
+
+	for _, src := range sources {
+		rc, err := src.open(ctx)
+		if err != nil {
+			log.Printf("[iptv-proxy] WARNING: xmltv source %s skipped: %v", src.name, err)
+			continue
+		}
+		closers = append(closers, rc)
+		merged = append(merged, xmltv.Source{Name: src.name, Reader: rc, Aliases: src.Aliases})
+	}
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("no xmltv source available")
+	}
+
+	scratch, err := ioutil.TempFile(xmltvCacheDir(), "iptv-proxy-merge-*.tmp")
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		start := time.Now()
+		err := xmltv.Merge(pw, scratch, merged...)
+
+		closeAll()
+		scratch.Close()           // nolint: errcheck
+		os.Remove(scratch.Name()) // nolint: errcheck
+
+		// The errors of the sources leave a valid guide, only the failing source is truncated
+		if err != nil && err != io.ErrClosedPipe {
+			log.Printf("[iptv-proxy] WARNING: xmltv merge: %v", err)
+		} else if err == nil {
+			log.Printf("[iptv-proxy] %d xmltv sources merged in %v", len(merged), time.Since(start).Round(time.Millisecond))
+		}
+		pw.Close() // nolint: errcheck
+	}()
+
+	return pr, nil
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+)
+
+const testGuide = `<tv><channel id="one"><display-name>Channel One</display-name></channel></tv>`
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(s)) // nolint: errcheck
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestXMLTV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(folder string) { config.CacheFolder = folder }(config.CacheFolder)
+	config.CacheFolder = dir
+
+	guide := gzipped(t, testGuide)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(guide) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	cache := newXMLTVCache(upstream.URL+"/xmltv.php", time.Hour)
+	if cache.ready() {
+		t.Fatal("Expected no cached guide")
+	}
+
+	router := gin.New()
+	router.GET("/stream", func(ctx *gin.Context) {
+		rc, err := openXMLTV(ctx.Request.Context(), upstream.URL+"/xmltv.php", "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer rc.Close()
+
+		if err := streamXMLTV(ctx, rc); err != nil {
+			t.Error(err)
+		}
+	})
+	router.GET("/cache", func(ctx *gin.Context) {
+		if err := cache.serve(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	acceptGzip := http.Header{"Accept-Encoding": {"gzip, deflate"}}
+
+	for _, path := range []string{"/stream", "/cache"} {
+		if path == "/cache" {
+			if err := cache.update(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !cache.ready() || cache.stale() {
+				t.Fatal("Expected a fresh cached guide")
+			}
+		}
+
+		// gzip is passed through
+		w := get(path, acceptGzip)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(w.Body.Bytes(), guide) {
+			t.Errorf("%s: expected the gzip guide, got %d %q", path, w.Code, w.Header().Get("Content-Encoding"))
+		}
+
+		// and decompressed for the clients not supporting it
+		w = get(path, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" || w.Body.String() != testGuide {
+			t.Errorf("%s: expected the plain guide, got %d %q", path, w.Code, w.Body.String())
+		}
+	}
+
+	etag := get("/cache", acceptGzip).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+	if w := get("/cache", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected the guide not to be sent again, got %d", w.Code)
+	}
+
+	// The cached guide is reused after a restart
+	if restarted := newXMLTVCache(upstream.URL+"/xmltv.php", time.Hour); !restarted.ready() || restarted.etag() != etag {
+		t.Errorf("Expected the cached guide to be reused")
+	}
+}
+
+func TestFilteredXMLTV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+`)
+
+	now := time.Now()
+	programme := func(channel string, start time.Time) string {
+		return fmt.Sprintf(`<programme channel="%s" start="%s" stop="%s"><title>%s</title></programme>`,
+			channel, start.Format(xmltv.TimeLayout), start.Add(time.Hour).Format(xmltv.TimeLayout), channel)
+	}
+	guidePath := filepath.Join(dir, "guide.xml.gz")
+	guide := `<tv><channel id="one"/><channel id="two"/>` +
+		programme("one", now.AddDate(0, 0, -3)) +
+		programme("one", now) +
+		programme("two", now) +
+		programme("one", now.AddDate(0, 0, 3)) +
+		`</tv>`
+	if err := ioutil.WriteFile(guidePath, gzipped(t, guide), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.XMLTVURL = guidePath
+	serverConfig.XMLTVFilter = true
+	serverConfig.XMLTVPastDays = 1
+	serverConfig.XMLTVFutureDays = 1
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	for _, encoding := range []string{"", "gzip"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/xmltv.php?username=test&password=test", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the guide to be served, got status %d", w.Code)
+		}
+		if w.Header().Get("Content-Encoding") != encoding {
+			t.Errorf("Expected the %q encoding, got %q", encoding, w.Header().Get("Content-Encoding"))
+		}
+
+		filtered, err := xmltv.Parse(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filtered.Channels) != 1 || filtered.Channels[0].ID != "one" {
+			t.Errorf("Expected only the playlist channel, got %+v", filtered.Channels)
+		}
+		if len(filtered.Programmes) != 1 || filtered.Programmes[0].Channel != "one" || filtered.Programmes[0].Start.Before(now.Add(-time.Minute)) {
+			t.Errorf("Expected only the current programme, got %+v", filtered.Programmes)
+		}
+	}
+}
+
+func TestXtreamXMLTVChannels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	panel := newFakeXtreamPanel(t)
+	defer panel.Close()
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(rulesPath, []byte("rules:\n  - group: News\n    set:\n      group-title: Local\n      tvg-id: local.one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rules.Load(rulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			XtreamBaseURL:  panel.URL,
+			XtreamUser:     "user",
+			XtreamPassword: "pass",
+		},
+		rules: rs,
+	}
+
+	// The channels of the guide are the rewritten live tracks the account can access
+	for _, tc := range []struct {
+		groups []string
+		want   map[string]bool
+	}{
+		{[]string{"Local"}, map[string]bool{"local.one": true}},
+		{[]string{"News"}, map[string]bool{}},
+	} {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/xmltv.php", nil)
+		ctx.Set(accountKey, &config.Account{Username: "alice", AllowedGroups: tc.groups})
+
+		channels, err := c.xmltvChannels(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(channels, tc.want) {
+			t.Errorf("%v: expected the channels %v, got %v", tc.groups, tc.want, channels)
+		}
+	}
+}
+
+func TestMergedXMLTV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(folder string) { config.CacheFolder = folder }(config.CacheFolder)
+	config.CacheFolder = dir
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, `#EXTM3U
+#EXTINF:-1 tvg-id="one" group-title="News",Channel One
+http://example.com/one.ts
+`)
+
+	provider := gzipped(t, `<tv><channel id="one"><display-name>Provider One</display-name></channel>`+
+		`<programme channel="one" start="20240101120000 +0000"><title>Provider</title></programme></tv>`)
+	available := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(provider) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	localPath := filepath.Join(dir, "local.xml")
+	local := `<tv><channel id="one"><display-name>Local One</display-name></channel>` +
+		`<channel id="local.two"><display-name>Local Two</display-name></channel>` +
+		`<programme channel="one" start="20240101120000 +0000"><title>Local</title></programme>` +
+		`<programme channel="local.two" start="20240101120000 +0000"><title>Two</title></programme></tv>`
+	if err := ioutil.WriteFile(localPath, []byte(local), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.XMLTVURL = upstream.URL + "/xmltv.php"
+	// Always stale, each update fetches the sources again
+	serverConfig.XMLTVCacheRefresh = time.Nanosecond
+	serverConfig.XMLTVSources = []config.XMLTVSource{{URL: localPath, Aliases: map[string]string{"local.two": "two"}}}
+	serverConfig.xmltv = serverConfig.newMergedXMLTVCache()
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	get := func() *xmltv.Guide {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xmltv.php?username=test&password=test", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the guide to be served, got status %d", w.Code)
+		}
+		tv, err := xmltv.Parse(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tv
+	}
+
+	check := func(tv *xmltv.Guide) {
+		t.Helper()
+		if len(tv.Channels) != 2 || tv.Channels[0].ID != "one" || tv.Channels[0].DisplayNames[0].Value != "Provider One" || tv.Channels[1].ID != "two" {
+			t.Errorf("Expected the provider channel and the aliased local one, got %+v", tv.Channels)
+		}
+		if len(tv.Programmes) != 2 || tv.Programmes[0].Title().Value != "Provider" || tv.Programmes[1].Channel != "two" {
+			t.Errorf("Expected the provider programmes first, got %+v", tv.Programmes)
+		}
+	}
+
+	// Merged on the fly until the guide is cached
+	check(get())
+
+	if err := serverConfig.xmltv.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !serverConfig.xmltv.ready() {
+		t.Fatal("Expected the merged guide to be cached")
+	}
+	check(get())
+
+	// A failing source keeps its previous copy
+	available = false
+	if err := serverConfig.xmltv.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(get())
+}
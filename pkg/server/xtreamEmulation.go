@@ -0,0 +1,471 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+	"github.com/jamesnetherton/m3u"
+)
+
+// programmeIndexRefresh is how often a guide not cached on disk is parsed again
+var programmeIndexRefresh = time.Hour
+
+// programmeIndexHistory is how long the ended programmes are kept, for the channels shifted back in time
+const programmeIndexHistory = 24 * time.Hour
+
+// xtreamEmulated reports whether the xtream API is emulated on top of the m3u playlist.
+func (c *Config) xtreamEmulated() bool {
+	return c.XtreamEmulation && c.XtreamBaseURL == ""
+}
+
+func (c *Config) xtreamEmulationRoutes(r *gin.RouterGroup) {
+	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
+	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
+	c.xtreamEmulationStreamRoutes(r)
+}
+
+func (c *Config) xtreamEmulationStreamRoutes(r *gin.RouterGroup) {
+	r.GET("/live/:username/:password/:id", c.pathAuthenticate, c.emulatedStreamLive)
+}
+
+// Emulated responses use string fields like the real panels do,
+// some clients don't accept numbers in their place.
+
+type emulatedLogin struct {
+	UserInfo   emulatedUserInfo   `json:"user_info"`
+	ServerInfo emulatedServerInfo `json:"server_info"`
+}
+
+type emulatedUserInfo struct {
+	Username             string   `json:"username"`
+	Password             string   `json:"password"`
+	Message              string   `json:"message"`
+	Auth                 int      `json:"auth"`
+	Status               string   `json:"status"`
+	ExpDate              *string  `json:"exp_date"`
+	IsTrial              string   `json:"is_trial"`
+	ActiveConnections    string   `json:"active_cons"`
+	CreatedAt            string   `json:"created_at"`
+	MaxConnections       string   `json:"max_connections"`
+	AllowedOutputFormats []string `json:"allowed_output_formats"`
+}
+
+type emulatedServerInfo struct {
+	URL          string `json:"url"`
+	Port         string `json:"port"`
+	HTTPSPort    string `json:"https_port"`
+	Protocol     string `json:"server_protocol"`
+	RTMPPort     string `json:"rtmp_port"`
+	Timezone     string `json:"timezone"`
+	TimestampNow int64  `json:"timestamp_now"`
+	TimeNow      string `json:"time_now"`
+}
+
+type emulatedCategory struct {
+	ID       string `json:"category_id"`
+	Name     string `json:"category_name"`
+	ParentID int    `json:"parent_id"`
+}
+
+type emulatedStream struct {
+	Num               int    `json:"num"`
+	Name              string `json:"name"`
+	StreamType        string `json:"stream_type"`
+	StreamID          int    `json:"stream_id"`
+	StreamIcon        string `json:"stream_icon"`
+	EPGChannelID      string `json:"epg_channel_id"`
+	Added             string `json:"added"`
+	CategoryID        string `json:"category_id"`
+	CustomSID         string `json:"custom_sid"`
+	TVArchive         int    `json:"tv_archive"`
+	DirectSource      string `json:"direct_source"`
+	TVArchiveDuration int    `json:"tv_archive_duration"`
+}
+
+type emulatedEPG struct {
+	Listings []emulatedListing `json:"epg_listings"`
+}
+
+type emulatedListing struct {
+	ID             string `json:"id"`
+	EPGID          string `json:"epg_id"`
+	Title          string `json:"title"`
+	Lang           string `json:"lang"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	Description    string `json:"description"`
+	ChannelID      string `json:"channel_id"`
+	StartTimestamp string `json:"start_timestamp"`
+	StopTimestamp  string `json:"stop_timestamp"`
+	NowPlaying     int    `json:"now_playing"`
+	HasArchive     int    `json:"has_archive"`
+}
+
+// emulatedPlayerAPI answers the player_api.php actions from the playlist.
+func (c *Config) emulatedPlayerAPI(ctx *gin.Context, action string, q url.Values) {
+	var resp interface{}
+
+	switch action {
+	case "get_live_categories":
+		resp = c.emulatedCategories(ctx)
+	case "get_live_streams":
+		resp = c.emulatedStreams(ctx, q.Get("category_id"))
+	case "get_short_epg", "get_simple_data_table":
+		limit := 0
+		if action == "get_short_epg" {
+			limit = 4
+			if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+				limit = l
+			}
+		}
+
+		epg, err := c.emulatedEPG(ctx, q.Get("stream_id"), limit)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		resp = epg
+	case "get_vod_categories", "get_vod_streams", "get_series_categories", "get_series":
+		resp = []struct{}{}
+	case "get_vod_info", "get_series_info":
+		resp = struct{}{}
+	default:
+		resp = c.emulatedLogin(ctx)
+	}
+
+	log.Printf("[iptv-proxy] %v | %s |Action\t%s (emulated)\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (c *Config) emulatedLogin(ctx *gin.Context) emulatedLogin {
+	account := accountFrom(ctx)
+	now := time.Now()
+
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+	port := strconv.Itoa(c.AdvertisedPort)
+
+	maxConnections := account.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = GetConnectionAccountant().Limit()
+	}
+
+	login := emulatedLogin{
+		UserInfo: emulatedUserInfo{
+			Username:             account.Username.String(),
+			Password:             account.Password.String(),
+			Auth:                 1,
+			Status:               "Active",
+			IsTrial:              "0",
+			ActiveConnections:    strconv.Itoa(c.users.activeConnections(account)),
+			CreatedAt:            strconv.FormatInt(now.Unix(), 10),
+			MaxConnections:       strconv.Itoa(maxConnections),
+			AllowedOutputFormats: []string{"ts"},
+		},
+		ServerInfo: emulatedServerInfo{
+			URL:          c.HostConfig.Hostname,
+			Port:         port,
+			HTTPSPort:    port,
+			Protocol:     protocol,
+			RTMPPort:     port,
+			Timezone:     "UTC",
+			TimestampNow: now.Unix(),
+			TimeNow:      now.UTC().Format("2006-01-02 15:04:05"),
+		},
+	}
+
+	if !account.ExpDate.IsZero() {
+		expDate := strconv.FormatInt(account.ExpDate.Unix(), 10)
+		login.UserInfo.ExpDate = &expDate
+	}
+
+	return login
+}
+
+// emulatedGroups returns the group-titles of the tracks in playlist order, and their category ids.
+func emulatedGroups(tracks []m3u.Track) ([]string, map[string]string) {
+	groups := make([]string, 0)
+	ids := make(map[string]string)
+	for _, track := range tracks {
+		group := rules.Tag(track, "group-title")
+		if _, ok := ids[group]; ok {
+			continue
+		}
+		ids[group] = ""
+		groups = append(groups, group)
+	}
+
+	// The ids colliding are resolved across all the groups
+	for i, id := range numericIDs(groups) {
+		ids[groups[i]] = strconv.Itoa(id)
+	}
+
+	return groups, ids
+}
+
+// emulatedCategories returns a category for each group-title allowed to the account.
+func (c *Config) emulatedCategories(ctx *gin.Context) []emulatedCategory {
+	account := accountFrom(ctx)
+	tracks, _, _ := c.tracks.snapshot()
+	groups, ids := emulatedGroups(tracks)
+
+	categories := make([]emulatedCategory, 0, len(groups))
+	for _, group := range groups {
+		if !account.AllowGroup(group) {
+			continue
+		}
+		categories = append(categories, emulatedCategory{ID: ids[group], Name: group})
+	}
+
+	return categories
+}
+
+// emulatedStreams returns the tracks allowed to the account, of the category if not empty.
+func (c *Config) emulatedStreams(ctx *gin.Context, categoryID string) []emulatedStream {
+	account := accountFrom(ctx)
+	tracks, _, streamIDs := c.tracks.snapshot()
+	_, groupIDs := emulatedGroups(tracks)
+
+	streams := make([]emulatedStream, 0, len(tracks))
+	for i, track := range tracks {
+		group := rules.Tag(track, "group-title")
+		if !account.AllowGroup(group) {
+			continue
+		}
+
+		groupID := groupIDs[group]
+		if categoryID != "" && categoryID != groupID {
+			continue
+		}
+
+		streams = append(streams, emulatedStream{
+			Num:          len(streams) + 1,
+			Name:         track.Name,
+			StreamType:   "live",
+			StreamID:     streamIDs[i],
+			StreamIcon:   c.imageURL(rules.Tag(track, "tvg-logo")),
+			EPGChannelID: rules.Tag(track, "tvg-id"),
+			Added:        "0",
+			CategoryID:   groupID,
+		})
+	}
+
+	return streams
+}
+
+// emulatedEPG returns the programmes of the stream not ended yet, at most limit if not zero.
+func (c *Config) emulatedEPG(ctx *gin.Context, streamID string, limit int) (emulatedEPG, error) {
+	epg := emulatedEPG{Listings: []emulatedListing{}}
+
+	id, err := strconv.Atoi(streamID)
+	if err != nil {
+		return epg, nil
+	}
+	track, _, ok := c.tracks.lookupStream(id)
+	if !ok || !accountFrom(ctx).AllowGroup(rules.Tag(*track, "group-title")) {
+		return epg, nil
+	}
+
+	channelID := rules.Tag(*track, "tvg-id")
+	if channelID == "" {
+		return epg, nil
+	}
+
+	now := time.Now()
+	programmes, err := c.channelProgrammes(ctx, channelID, now)
+	if err != nil {
+		return epg, err
+	}
+
+	for _, p := range programmes {
+		if !p.Stop.IsZero() && !p.Stop.After(now) {
+			continue
+		}
+		if limit > 0 && len(epg.Listings) >= limit {
+			break
+		}
+
+		nowPlaying := 0
+		if !p.Start.After(now) {
+			nowPlaying = 1
+		}
+
+		title, desc := p.Title(), p.Description()
+		epg.Listings = append(epg.Listings, emulatedListing{
+			ID:             strconv.FormatInt(p.Start.Unix(), 10),
+			EPGID:          strconv.Itoa(id),
+			Title:          base64.StdEncoding.EncodeToString([]byte(title.Value)),
+			Lang:           title.Lang,
+			Start:          p.Start.UTC().Format("2006-01-02 15:04:05"),
+			End:            p.Stop.UTC().Format("2006-01-02 15:04:05"),
+			Description:    base64.StdEncoding.EncodeToString([]byte(desc.Value)),
+			ChannelID:      channelID,
+			StartTimestamp: strconv.FormatInt(p.Start.Unix(), 10),
+			StopTimestamp:  strconv.FormatInt(p.Stop.Unix(), 10),
+			NowPlaying:     nowPlaying,
+		})
+	}
+
+	return epg, nil
+}
+
+// channelProgrammes returns the programmes of the channel not ended at from, shifted by the offset of
+// the channel, nil if there is no guide. They come from the index of the served guide, cached and
+// merged from the XMLTV sources.
+func (c *Config) channelProgrammes(ctx *gin.Context, channelID string, from time.Time) ([]xmltv.Programme, error) {
+	if c.xmltvSource() == "" && len(c.XMLTVSources) == 0 {
+		return nil, nil
+	}
+
+	channels, err := c.programmes.get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := c.epgOffsets.get()[channelID]
+	programmes := make([]xmltv.Programme, 0)
+	for _, p := range channels[channelID] {
+		if offset != 0 {
+			p.Start.Time = p.Start.Add(offset)
+			if !p.Stop.IsZero() {
+				p.Stop.Time = p.Stop.Add(offset)
+			}
+		}
+		if !p.Stop.IsZero() && p.Stop.Before(from) {
+			continue
+		}
+		programmes = append(programmes, p)
+	}
+
+	return programmes, nil
+}
+
+// programmeIndex holds the programmes of the served guide by channel, the guide is parsed
+// once per refresh rather than on each EPG request.
+type programmeIndex struct {
+	sync.Mutex
+	// guide indexed, its modification time when cached on disk
+	cache    *xmltvCache
+	source   string
+	version  time.Time
+	loaded   time.Time
+	channels map[string][]xmltv.Programme
+}
+
+// get returns the programmes by channel sorted by start time, parsing the guide if it changed.
+// A nil index parses the guide on each call.
+func (x *programmeIndex) get(ctx *gin.Context, c *Config) (map[string][]xmltv.Programme, error) {
+	if x == nil {
+		x = &programmeIndex{}
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	var version time.Time
+	if c.xmltv != nil {
+		version = c.xmltv.version()
+	}
+	if x.channels != nil && x.cache == c.xmltv && x.source == c.xmltvSource() {
+		if !version.IsZero() && version.Equal(x.version) {
+			return x.channels, nil
+		}
+		if version.IsZero() && x.version.IsZero() && time.Since(x.loaded) < programmeIndexRefresh {
+			return x.channels, nil
+		}
+	}
+
+	rc, err := c.openXMLTVGuide(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	since := time.Now().Add(-programmeIndexHistory)
+	channels := make(map[string][]xmltv.Programme)
+	err = xmltv.ReadProgrammes(rc, func(p xmltv.Programme) {
+		if !p.Stop.IsZero() && p.Stop.Before(since) {
+			return
+		}
+		channels[p.Channel] = append(channels[p.Channel], p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, programmes := range channels {
+		sort.SliceStable(programmes, func(i, j int) bool { return programmes[i].Start.Before(programmes[j].Start.Time) })
+	}
+
+	x.cache, x.source, x.version, x.loaded, x.channels = c.xmltv, c.xmltvSource(), version, time.Now(), channels
+
+	return channels, nil
+}
+
+// emulatedStreamLive serves /live/:username/:password/:id, id being the stream id with its extension.
+func (c *Config) emulatedStreamLive(ctx *gin.Context) {
+	id := ctx.Param("id")
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	track, trackID, ok := c.tracks.lookupStream(streamID)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// HLS playlists are served by the m3u endpoint, their segments are relative to it
+	if strings.HasSuffix(track.URI, ".m3u8") {
+		if !accountFrom(ctx).AllowGroup(rules.Tag(*track, "group-title")) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, path.Join(
+			"/",
+			strings.Trim(c.CustomEndpoint, "/"),
+			c.endpointAntiColision,
+			url.PathEscape(ctx.Param("username")),
+			url.PathEscape(ctx.Param("password")),
+			trackID,
+			path.Base(track.URI),
+		))
+		return
+	}
+
+	c.serveTrack(ctx, track)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/xmltv"
+	"github.com/jamesnetherton/m3u"
+)
+
+func TestXtreamEmulation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stream " + r.URL.Path)) // nolint: errcheck
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	playlistPath := filepath.Join(dir, "source.m3u")
+	writePlaylist(t, playlistPath, fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="one" tvg-logo="http://example.com/one.png" group-title="News",Channel One
+%[1]s/one.ts
+#EXTINF:-1 tvg-id="two" group-title="Sports",Channel Two
+%[1]s/two/index.m3u8
+`, upstream.URL))
+
+	now := time.Now()
+	xmltvPath := filepath.Join(dir, "guide.xml")
+	programme := func(start, stop time.Time, title string) string {
+		return fmt.Sprintf(`<programme channel="one" start="%s" stop="%s"><title lang="en">%s</title><desc>About %s</desc></programme>`,
+			start.Format(xmltv.TimeLayout), stop.Format(xmltv.TimeLayout), title, title)
+	}
+	guide := `<tv><channel id="one"><display-name>Channel One</display-name></channel>` +
+		programme(now.Add(-2*time.Hour), now.Add(-time.Hour), "Past") +
+		programme(now.Add(-time.Hour), now.Add(time.Hour), "Current") +
+		programme(now.Add(time.Hour), now.Add(2*time.Hour), "Next") +
+		`</tv>`
+	if err := ioutil.WriteFile(xmltvPath, []byte(guide), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := newTestM3UServer(t, playlistPath)
+	serverConfig.XtreamEmulation = true
+	serverConfig.XMLTVURL = xmltvPath
+	if err := serverConfig.playlistInitialization(); err != nil {
+		t.Fatalf("Failed to initialize playlist: %v", err)
+	}
+
+	router := gin.New()
+	serverConfig.routes(router.Group("/"))
+
+	// Streams need a real connection, gin waits for the client to close it
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(path string, code int) (*http.Response, []byte) {
+		resp, err := client.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != code {
+			t.Fatalf("Expected status %d for %s, got %d", code, path, resp.StatusCode)
+		}
+		return resp, body
+	}
+	playerAPI := func(action string, v interface{}) {
+		_, body := get("/player_api.php?username=test&password=test&action="+action, http.StatusOK)
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+	}
+
+	var login emulatedLogin
+	playerAPI("", &login)
+	if login.UserInfo.Username != "test" || login.UserInfo.Auth != 1 || login.ServerInfo.URL != "localhost" || login.ServerInfo.Port != "8080" {
+		t.Errorf("Unexpected login %+v", login)
+	}
+
+	var categories []emulatedCategory
+	playerAPI("get_live_categories", &categories)
+	if len(categories) != 2 || categories[0].Name != "News" || categories[1].Name != "Sports" {
+		t.Fatalf("Unexpected categories %+v", categories)
+	}
+
+	var streams []emulatedStream
+	playerAPI("get_live_streams&category_id="+categories[0].ID, &streams)
+	if len(streams) != 1 || streams[0].Name != "Channel One" || streams[0].EPGChannelID != "one" ||
+		streams[0].StreamIcon != "http://example.com/one.png" || streams[0].StreamID == 0 {
+		t.Fatalf("Unexpected streams %+v", streams)
+	}
+	playerAPI("get_live_streams", &streams)
+	if len(streams) != 2 {
+		t.Fatalf("Expected all the streams, got %+v", streams)
+	}
+
+	// Stream ids are derived from the track ids, not from the track positions
+	_, _, streamIDs := serverConfig.tracks.snapshot()
+	if ids := numericIDs(trackIDs(serverConfig.playlist.Tracks)); ids[0] != streamIDs[0] || ids[1] != streamIDs[1] {
+		t.Errorf("Expected stable stream ids, got %v and %v", ids, streamIDs)
+	}
+
+	var epg emulatedEPG
+	playerAPI("get_short_epg&stream_id="+strconv.Itoa(streams[0].StreamID), &epg)
+	if len(epg.Listings) != 2 {
+		t.Fatalf("Expected the current and next programmes, got %+v", epg.Listings)
+	}
+	if title, _ := base64.StdEncoding.DecodeString(epg.Listings[0].Title); string(title) != "Current" || epg.Listings[0].NowPlaying != 1 {
+		t.Errorf("Unexpected current programme %+v", epg.Listings[0])
+	}
+	playerAPI("get_short_epg&limit=1&stream_id="+strconv.Itoa(streams[0].StreamID), &epg)
+	if len(epg.Listings) != 1 {
+		t.Errorf("Expected the limit to be applied, got %+v", epg.Listings)
+	}
+
+	// The guide of the second channel comes from a merged source
+	extraPath := filepath.Join(dir, "extra.xml")
+	extra := `<tv><channel id="two"><display-name>Channel Two</display-name></channel>` +
+		strings.Replace(programme(now.Add(-time.Hour), now.Add(time.Hour), "Match"), `channel="one"`, `channel="two"`, 1) +
+		`</tv>`
+	if err := ioutil.WriteFile(extraPath, []byte(extra), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(folder string) { config.CacheFolder = folder }(config.CacheFolder)
+	config.CacheFolder = dir
+	serverConfig.XMLTVSources = []config.XMLTVSource{{URL: extraPath}}
+	serverConfig.xmltv = serverConfig.newMergedXMLTVCache()
+
+	playerAPI("get_short_epg&stream_id="+strconv.Itoa(streams[1].StreamID), &epg)
+	if len(epg.Listings) != 1 {
+		t.Fatalf("Expected the programme of the merged source, got %+v", epg.Listings)
+	}
+	if title, _ := base64.StdEncoding.DecodeString(epg.Listings[0].Title); string(title) != "Match" {
+		t.Errorf("Unexpected programme %+v", epg.Listings[0])
+	}
+
+	_, body := get(fmt.Sprintf("/live/test/test/%d.ts", streams[0].StreamID), http.StatusOK)
+	if string(body) != "stream /one.ts" {
+		t.Errorf("Unexpected stream %q", body)
+	}
+
+	ids := trackIDs(serverConfig.playlist.Tracks)
+	resp, _ := get(fmt.Sprintf("/live/test/test/%d.m3u8", streams[1].StreamID), http.StatusFound)
+	if location := resp.Header.Get("Location"); location != "/"+serverConfig.endpointAntiColision+"/test/test/"+ids[1]+"/index.m3u8" {
+		t.Errorf("Unexpected HLS redirection %q", location)
+	}
+
+	get("/live/test/test/1.ts", http.StatusNotFound)
+	get("/live/test/wrong/1.ts", http.StatusUnauthorized)
+}
+
+func TestEmulatedCategoryIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// The hashes of these groups collide
+	tracks := []m3u.Track{
+		{Name: "One", URI: "http://example.com/one.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Group 122789"}}},
+		{Name: "Two", URI: "http://example.com/two.ts", Tags: []m3u.Tag{{Name: "group-title", Value: "Group 339192"}}},
+	}
+	c := &Config{ProxyConfig: &config.ProxyConfig{}, tracks: newTrackTable()}
+	c.tracks.set(tracks)
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Set(accountKey, &config.Account{})
+
+	categories := c.emulatedCategories(ctx)
+	if len(categories) != 2 || categories[0].ID == categories[1].ID {
+		t.Fatalf("Expected distinct category ids, got %+v", categories)
+	}
+	for i, stream := range c.emulatedStreams(ctx, "") {
+		if stream.CategoryID != categories[i].ID {
+			t.Errorf("Expected stream %s in category %s, got %s", stream.Name, categories[i].ID, stream.CategoryID)
+		}
+	}
+	if streams := c.emulatedStreams(ctx, categories[1].ID); len(streams) != 1 || streams[0].Name != "Two" {
+		t.Errorf("Expected the stream of the second category, got %+v", streams)
+	}
+}
+
+func TestProgrammeIndex(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := ioutil.TempDir("", "iptv-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeGuide := func(title string) {
+		guide := fmt.Sprintf(`<tv><programme channel="one" start="%s" stop="%s"><title>%s</title></programme></tv>`,
+			now.Add(-time.Hour).Format(xmltv.TimeLayout), now.Add(time.Hour).Format(xmltv.TimeLayout), title)
+		if err := ioutil.WriteFile(filepath.Join(dir, "guide.xml"), []byte(guide), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeGuide("First")
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{XMLTVURL: filepath.Join(dir, "guide.xml")},
+		epgOffsets:  newEPGOffsets(),
+		programmes:  &programmeIndex{},
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php", nil)
+
+	title := func() string {
+		programmes, err := c.channelProgrammes(ctx, "one", now)
+		if err != nil || len(programmes) != 1 {
+			t.Fatalf("Expected the programme of the channel, got %+v: %v", programmes, err)
+		}
+		return programmes[0].Title().Value
+	}
+
+	// The guide is parsed once, until its refresh
+	if got := title(); got != "First" {
+		t.Errorf("Unexpected programme %q", got)
+	}
+	writeGuide("Second")
+	if got := title(); got != "First" {
+		t.Errorf("Expected the indexed programme, got %q", got)
+	}
+	c.programmes.loaded = now.Add(-programmeIndexRefresh)
+	if got := title(); got != "Second" {
+		t.Errorf("Expected the guide to be parsed again after its refresh, got %q", got)
+	}
+}
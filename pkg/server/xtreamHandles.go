@@ -26,13 +26,17 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jamesnetherton/m3u"
+	"github.com/incmve/iptv-proxy/pkg/rules"
 	xtreamapi "github.com/incmve/iptv-proxy/pkg/xtream-proxy"
 	uuid "github.com/satori/go.uuid"
 )
@@ -72,12 +76,108 @@ func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error
 	return nil
 }
 
-func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+// clearXtreamM3uCache removes the cached m3u files.
+func clearXtreamM3uCache() {
+	xtreamM3uCacheLock.Lock()
+	defer xtreamM3uCacheLock.Unlock()
+
+	for name, meta := range xtreamM3uCache {
+		if err := os.Remove(meta.string); err != nil && !os.IsNotExist(err) {
+			log.Printf("[iptv-proxy] WARNING: unable to remove cached playlist: %v", err)
+		}
+		delete(xtreamM3uCache, name)
+	}
+}
+
+// xtreamClient returns the authenticated client of the xtream provider,
+// reused across the requests.
+func (c *Config) xtreamClient(ctx *gin.Context) (*xtreamapi.Client, error) {
+	return c.xtreamClients.Get(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+}
+
+// Content types of the playlist generated from the xtream API
+const (
+	xtreamLive   = "live"
+	xtreamVOD    = "vod"
+	xtreamSeries = "series"
+)
+
+// xtreamGroupPrefixes are prepended to the group titles when several content types are generated.
+var xtreamGroupPrefixes = map[string]string{
+	xtreamLive:   "Live | ",
+	xtreamVOD:    "Movies | ",
+	xtreamSeries: "Series | ",
+}
+
+// parseXtreamContents parses the comma separated content types of the playlist,
+// e.g: "live,vod,series". Only the live streams are generated if empty.
+func parseXtreamContents(s string) ([]string, error) {
+	wanted := make(map[string]bool)
+	for _, content := range strings.Split(s, ",") {
+		switch content = strings.ToLower(strings.TrimSpace(content)); content {
+		case "":
+		case xtreamLive, xtreamVOD, xtreamSeries:
+			wanted[content] = true
+		case "movie", "movies":
+			wanted[xtreamVOD] = true
+		default:
+			return nil, fmt.Errorf("unknown content type %q", content)
+		}
+	}
+
+	contents := make([]string, 0, len(wanted))
+	for _, content := range []string{xtreamLive, xtreamVOD, xtreamSeries} {
+		if wanted[content] {
+			contents = append(contents, content)
+		}
+	}
+	if len(contents) == 0 {
+		contents = append(contents, xtreamLive)
+	}
+
+	return contents, nil
+}
+
+func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string, contents []string) (*m3u.Playlist, error) {
+	client, err := c.xtreamClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	var playlist = new(m3u.Playlist)
+	playlist.Tracks = make([]m3u.Track, 0)
+
+	for _, content := range contents {
+		var tracks []m3u.Track
+		switch content {
+		case xtreamVOD:
+			tracks, err = c.xtreamVODTracks(client)
+		case xtreamSeries:
+			tracks, err = c.xtreamSeriesTracks(client)
+		default:
+			tracks, err = c.xtreamLiveTracks(client, extension)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The rules and the account groups apply to the provider categories, the prefix is added after
+		for _, track := range c.rules.Apply(tracks) {
+			group := rules.Tag(track, "group-title")
+			if c.account != nil && !c.account.AllowGroup(group) {
+				continue
+			}
+			if group != "" && len(contents) > 1 {
+				rules.SetTag(&track, "group-title", xtreamGroupPrefixes[content]+group)
+			}
+			playlist.Tracks = append(playlist.Tracks, track)
+		}
+	}
+
+	return playlist, nil
+}
+
+func (c *Config) xtreamLiveTracks(client *xtreamapi.Client, extension string) ([]m3u.Track, error) {
 	cat, err := client.GetLiveCategories()
 	if err != nil {
 		return nil, err
@@ -91,9 +191,7 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 		prefix = "live/"
 	}
 
-	var playlist = new(m3u.Playlist)
-	playlist.Tracks = make([]m3u.Track, 0)
-
+	tracks := make([]m3u.Track, 0)
 	for _, category := range cat {
 		live, err := client.GetLiveStreams(fmt.Sprint(category.ID))
 		if err != nil {
@@ -101,28 +199,116 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 		}
 
 		for _, stream := range live {
-			track := m3u.Track{Name: stream.Name, Length: -1, URI: "", Tags: nil}
+			uri := fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), extension)
+			tracks = append(tracks, xtreamTrack(stream.Name, stream.EPGChannelID, stream.Icon, category.Name, uri))
+		}
+	}
 
-			//TODO: Add more tag if needed.
-			if stream.EPGChannelID != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: stream.EPGChannelID})
-			}
-			if stream.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: stream.Name})
+	return tracks, nil
+}
+
+func (c *Config) xtreamVODTracks(client *xtreamapi.Client) ([]m3u.Track, error) {
+	cat, err := client.GetVideoOnDemandCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]m3u.Track, 0)
+	for _, category := range cat {
+		movies, err := client.GetVideoOnDemandStreams(fmt.Sprint(category.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, movie := range movies {
+			uri := c.xtreamContentURL("movie", fmt.Sprint(movie.ID), movie.ContainerExtension)
+			tracks = append(tracks, xtreamTrack(movie.Name, "", movie.Icon, category.Name, uri))
+		}
+	}
+
+	return tracks, nil
+}
+
+// xtreamSeriesTracks returns a track for each episode, it needs a request per series.
+func (c *Config) xtreamSeriesTracks(client *xtreamapi.Client) ([]m3u.Track, error) {
+	cat, err := client.GetSeriesCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]m3u.Track, 0)
+	for _, category := range cat {
+		series, err := client.GetSeries(fmt.Sprint(category.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, serie := range series {
+			info, err := client.GetSeriesInfo(fmt.Sprint(serie.SeriesID))
+			if err != nil {
+				log.Printf("[iptv-proxy] WARNING: unable to get the episodes of %q: %v", serie.Name, err)
+				continue
 			}
-			if stream.Icon != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: stream.Icon})
+
+			seasons := make([]string, 0, len(info.Episodes))
+			for season := range info.Episodes {
+				seasons = append(seasons, season)
 			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+			sort.Slice(seasons, func(i, j int) bool {
+				si, _ := strconv.Atoi(seasons[i])
+				sj, _ := strconv.Atoi(seasons[j])
+				return si < sj
+			})
+
+			for _, season := range seasons {
+				for _, episode := range info.Episodes[season] {
+					name := episode.Title
+					if name == "" {
+						name = fmt.Sprintf("%s S%02dE%02d", serie.Name, int(episode.Season), int(episode.EpisodeNum))
+					}
+					logo := episode.Info.MovieImage
+					if logo == "" {
+						logo = serie.Cover
+					}
+
+					uri := c.xtreamContentURL("series", episode.ID, episode.ContainerExtension)
+					tracks = append(tracks, xtreamTrack(name, "", logo, category.Name, uri))
+				}
 			}
-
-			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), extension)
-			playlist.Tracks = append(playlist.Tracks, track)
 		}
 	}
 
-	return playlist, nil
+	return tracks, nil
+}
+
+// xtreamContentURL returns the upstream url of a movie or an episode.
+func (c *Config) xtreamContentURL(kind, id, extension string) string {
+	uri := fmt.Sprintf("%s/%s/%s/%s/%s", c.XtreamBaseURL, kind, c.XtreamUser, c.XtreamPassword, id)
+	if extension != "" {
+		uri += "." + extension
+	}
+
+	return uri
+}
+
+func xtreamTrack(name, epgChannelID, logo, group, uri string) m3u.Track {
+	track := m3u.Track{Name: name, Length: -1, URI: uri, Tags: nil}
+
+	//TODO: Add more tag if needed.
+	if epgChannelID != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: epgChannelID})
+	}
+	if name != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: name})
+	}
+	if logo != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: logo})
+	}
+	if group != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: group})
+	}
+
+	return track
 }
 
 func (c *Config) xtreamGetAuto(ctx *gin.Context) {
@@ -141,6 +327,8 @@ func (c *Config) xtreamGetAuto(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamGet(ctx *gin.Context) {
+	c = c.withAccount(ctx)
+
 	rawURL := fmt.Sprintf("%s/get.php?username=%s&password=%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword)
 
 	q := ctx.Request.URL.Query()
@@ -158,29 +346,33 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
+	cacheName := c.account.Username.String() + "|" + m3uURL.String()
 
 	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[m3uURL.String()]
+	meta, ok := xtreamM3uCache[cacheName]
 	d := time.Since(meta.Time)
 	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
 		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
 		xtreamM3uCacheLock.RUnlock()
+		GetMetrics().CacheLookup(false)
 		playlist, err := m3u.Parse(m3uURL.String())
 		if err != nil {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
-		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
+		playlist.Tracks = c.rules.Apply(playlist.Tracks)
+		if err := c.cacheXtreamM3u(&playlist, cacheName); err != nil {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
 	} else {
 		xtreamM3uCacheLock.RUnlock()
+		GetMetrics().CacheLookup(true)
 	}
 
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[m3uURL.String()].string
+	path := xtreamM3uCache[cacheName].string
 	xtreamM3uCacheLock.RUnlock()
 	ctx.Header("Content-Type", "application/octet-stream")
 
@@ -188,14 +380,34 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamApiGet(ctx *gin.Context) {
+	c = c.withAccount(ctx)
+
+	contents, err := parseXtreamContents(ctx.Query("types"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	path, err := c.xtreamApiGetPath(ctx, ctx.Query("output"), contents)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Header("Content-Type", "application/octet-stream")
+
+	ctx.File(path)
+
+}
+
+// xtreamApiGetPath returns the cached m3u file generated from the xtream API for the account.
+func (c *Config) xtreamApiGetPath(ctx *gin.Context, extension string, contents []string) (string, error) {
 	const (
 		apiGet = "apiget"
 	)
 
-	var (
-		extension = ctx.Query("output")
-		cacheName = apiGet + extension
-	)
+	cacheName := c.account.Username.String() + "|" + apiGet + extension + "|" + strings.Join(contents, ",")
 
 	xtreamM3uCacheLock.RLock()
 	meta, ok := xtreamM3uCache[cacheName]
@@ -203,27 +415,26 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
 		log.Printf("[iptv-proxy] %v | %s | xtream cache API m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
 		xtreamM3uCacheLock.RUnlock()
-		playlist, err := c.xtreamGenerateM3u(ctx, extension)
+		GetMetrics().CacheLookup(false)
+		playlist, err := c.xtreamGenerateM3u(ctx, extension, contents)
 		if err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-			return
+			return "", err
 		}
-		if err := c.cacheXtreamM3u(playlist, cacheName); err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-			return
+		generated := *c
+		generated.accountFiltered = true
+		if err := generated.cacheXtreamM3u(playlist, cacheName); err != nil {
+			return "", err
 		}
 	} else {
 		xtreamM3uCacheLock.RUnlock()
+		GetMetrics().CacheLookup(true)
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	xtreamM3uCacheLock.RLock()
 	path := xtreamM3uCache[cacheName].string
 	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(path)
 
+	return path, nil
 }
 
 func (c *Config) xtreamPlayerAPIGET(ctx *gin.Context) {
@@ -251,14 +462,21 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 	if len(q["action"]) > 0 {
 		action = q["action"][0]
 	}
+	GetMetrics().APIAction(xtreamapi.ActionName(action))
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	if c.xtreamEmulated() {
+		c.emulatedPlayerAPI(ctx, action, q)
+		return
+	}
+
+	client, err := c.xtreamClient(ctx)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
-	resp, httpcode, err := client.Action(c.ProxyConfig, action, q)
+	account := accountFrom(ctx)
+	resp, httpcode, err := client.Action(c.ProxyConfig, account, c.users.activeConnections(account), action, q)
 	if err != nil {
 		ctx.AbortWithError(httpcode, err) // nolint: errcheck
 		return
@@ -266,50 +484,49 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 
 	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
 
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+	if c.images != nil {
+		xtreamapi.RewriteImages(resp, c.imageURL)
 	}
 
-	ctx.JSON(http.StatusOK, resp)
-}
-
-func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
+	if err = c.shiftEPGResponse(ctx, resp); err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
-	resp, err := client.GetXMLTV()
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
-	}
+	ctx.JSON(http.StatusOK, resp)
+}
 
-	ctx.Data(http.StatusOK, "application/xml", resp)
+// xtreamXMLTVURL returns the url of the provider XMLTV guide.
+func (c *Config) xtreamXMLTVURL() string {
+	return fmt.Sprintf("%s/xmltv.php?username=%s&password=%s", c.XtreamBaseURL, url.QueryEscape(c.XtreamUser.String()), url.QueryEscape(c.XtreamPassword.String()))
 }
 
 func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
 	id := ctx.Param("id")
+	if !c.xtreamAllowed(ctx, "live", id) {
+		return
+	}
 	rpURL, err := url.Parse(fmt.Sprintf("%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.xtreamLiveStream(ctx, rpURL)
 }
 
 func (c *Config) xtreamStreamLive(ctx *gin.Context) {
 	id := ctx.Param("id")
+	if !c.xtreamAllowed(ctx, "live", id) {
+		return
+	}
 	rpURL, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.xtreamLiveStream(ctx, rpURL)
 }
 
 func (c *Config) xtreamStreamPlay(ctx *gin.Context) {
@@ -328,6 +545,21 @@ func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 	duration := ctx.Param("duration")
 	start := ctx.Param("start")
 	id := ctx.Param("id")
+	if !c.xtreamAllowed(ctx, "live", id) {
+		return
+	}
+
+	// Played from the local recording when it goes back to start, by the provider otherwise
+	if startTime, err := time.ParseInLocation(timeshiftStartLayout, start, time.Local); err == nil {
+		liveURL, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+		if err == nil {
+			if recording := c.timeshift.lookup(liveURL.String()); recording != nil && recording.covers(startTime) {
+				c.streamTimeshift(ctx, liveURL, recording, startTime)
+				return
+			}
+		}
+	}
+
 	rpURL, err := url.Parse(fmt.Sprintf("%s/timeshift/%s/%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, duration, start, id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -339,6 +571,9 @@ func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 
 func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
 	id := ctx.Param("id")
+	if !c.xtreamAllowed(ctx, "vod", id) {
+		return
+	}
 	rpURL, err := url.Parse(fmt.Sprintf("%s/movie/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -350,6 +585,9 @@ func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
 
 func (c *Config) xtreamStreamSeries(ctx *gin.Context) {
 	id := ctx.Param("id")
+	if !c.xtreamAllowed(ctx, "episode", id) {
+		return
+	}
 	rpURL, err := url.Parse(fmt.Sprintf("%s/series/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -493,7 +731,8 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 				return
 			}
 			body := string(b)
-			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+c.User.String()+"/"+c.Password.String()+"/")
+			user, password := c.withAccount(ctx).credentials()
+			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+user.String()+"/"+password.String()+"/")
 
 			mergeHttpHeader(ctx.Writer.Header(), hlsResp.Header)
 
@@ -506,3 +745,38 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 
 	ctx.Status(resp.StatusCode)
 }
+
+// xtreamAllowed reports whether the account of the request can access the stream id of streamType,
+// see xtreamapi.Client.Allowed. The request is aborted when it can't.
+func (c *Config) xtreamAllowed(ctx *gin.Context, streamType, id string) bool {
+	account := accountFrom(ctx)
+	if account == nil || len(account.AllowedGroups) == 0 {
+		return true
+	}
+
+	client, err := c.xtreamClient(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return false
+	}
+
+	allowed, err := client.Allowed(account, streamType, strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return false
+	}
+	if !allowed {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// withAccount returns a copy of the config for the account authenticated for the request.
+func (c *Config) withAccount(ctx *gin.Context) *Config {
+	tmp := *c
+	tmp.account = accountFrom(ctx)
+
+	return &tmp
+}
@@ -1,7 +1,17 @@
 package server
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/incmve/iptv-proxy/pkg/config"
+	"github.com/incmve/iptv-proxy/pkg/rules"
+	xtreamapi "github.com/incmve/iptv-proxy/pkg/xtream-proxy"
 )
 
 // TestBasicServerFunctionality tests that the server package compiles and basic types work
@@ -19,4 +29,208 @@ func TestBasicServerFunctionality(t *testing.T) {
 		// If the package compiles, the imports are working
 		t.Log("All imports are working correctly")
 	})
-}
\ No newline at end of file
+}
+
+// fakeXtreamResponses are the player_api.php responses of newFakeXtreamPanel by action
+var fakeXtreamResponses = map[string]string{
+	"":                      `{"user_info":{"username":"user","password":"pass","auth":1,"status":"Active","max_connections":"2"},"server_info":{"url":"panel","port":"80"}}`,
+	"get_live_categories":   `[{"category_id":"1","category_name":"News","parent_id":0}]`,
+	"get_live_streams":      `[{"num":1,"name":"Channel One","stream_type":"live","stream_id":11,"epg_channel_id":"one","category_id":"1"}]`,
+	"get_vod_categories":    `[{"category_id":"2","category_name":"Action","parent_id":0}]`,
+	"get_vod_streams":       `[{"num":1,"name":"Movie","stream_type":"movie","stream_id":21,"stream_icon":"http://panel/movie.png","category_id":"2","container_extension":"mp4"}]`,
+	"get_series_categories": `[{"category_id":"3","category_name":"Drama","parent_id":0}]`,
+	"get_series":            `[{"num":1,"name":"Tulsa King","series_id":31,"cover":"http://panel/cover.png","category_id":"3"}]`,
+}
+
+// newFakeXtreamPanel serves the player_api.php of an xtream provider for user/pass.
+func newFakeXtreamPanel(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	seriesInfo, err := ioutil.ReadFile(filepath.Join("xtreamHandles_test_data", "get_series_info.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/player_api.php" || q.Get("username") != "user" || q.Get("password") != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		action := q.Get("action")
+		if action == "get_series_info" {
+			w.Write(seriesInfo) // nolint: errcheck
+			return
+		}
+		resp, ok := fakeXtreamResponses[action]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(resp)) // nolint: errcheck
+	}))
+}
+
+func TestParseXtreamContents(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":                  "live",
+		"vod":               "vod",
+		"series, movies":    "vod,series",
+		"series,vod,live":   "live,vod,series",
+		"live,live,series,": "live,series",
+	} {
+		contents, err := parseXtreamContents(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if strings.Join(contents, ",") != expected {
+			t.Errorf("%q: expected %s, got %v", s, expected, contents)
+		}
+	}
+
+	if _, err := parseXtreamContents("live,radio"); err == nil {
+		t.Error("Expected an error for an unknown content type")
+	}
+}
+
+func TestXtreamGenerateM3u(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	panel := newFakeXtreamPanel(t)
+	defer panel.Close()
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			XtreamBaseURL:  panel.URL,
+			XtreamUser:     "user",
+			XtreamPassword: "pass",
+		},
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/apiget", nil)
+
+	playlist, err := c.xtreamGenerateM3u(ctx, "ts", []string{xtreamLive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Tracks) != 1 || playlist.Tracks[0].URI != panel.URL+"/live/user/pass/11.ts" ||
+		rules.Tag(playlist.Tracks[0], "group-title") != "News" {
+		t.Fatalf("Unexpected live playlist %+v", playlist.Tracks)
+	}
+
+	playlist, err = c.xtreamGenerateM3u(ctx, "ts", []string{xtreamLive, xtreamVOD, xtreamSeries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 channel, 1 movie and the 16 episodes of the series
+	if len(playlist.Tracks) != 18 {
+		t.Fatalf("Expected 18 tracks, got %d", len(playlist.Tracks))
+	}
+
+	live, movie, episode := playlist.Tracks[0], playlist.Tracks[1], playlist.Tracks[2]
+	if group := rules.Tag(live, "group-title"); group != "Live | News" {
+		t.Errorf("Unexpected live group %q", group)
+	}
+	if movie.URI != panel.URL+"/movie/user/pass/21.mp4" || rules.Tag(movie, "group-title") != "Movies | Action" ||
+		rules.Tag(movie, "tvg-logo") != "http://panel/movie.png" {
+		t.Errorf("Unexpected movie %+v", movie)
+	}
+	if episode.URI != panel.URL+"/series/user/pass/417904.mkv" || rules.Tag(episode, "group-title") != "Series | Drama" ||
+		episode.Name != "EN - Tulsa King - S01E01 - Go West, Old Man" {
+		t.Errorf("Unexpected episode %+v", episode)
+	}
+	if last := playlist.Tracks[17]; !strings.Contains(last.Name, "S02E") {
+		t.Errorf("Expected the seasons in order, got %+v", last)
+	}
+
+	// The groups of an account match the categories, not the prefixed group titles
+	c.HostConfig = &config.HostConfiguration{Hostname: "localhost", Port: 8080}
+	c.account = &config.Account{Username: "alice", Password: "secret", AllowedGroups: []string{"News", "Drama"}}
+	defer clearXtreamM3uCache()
+	path, err := c.xtreamApiGetPath(ctx, "ts", []string{xtreamLive, xtreamVOD, xtreamSeries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), `group-title="Live | News"`) != 1 || strings.Count(string(data), `group-title="Series | Drama"`) != 16 ||
+		strings.Contains(string(data), "Action") {
+		t.Errorf("Expected the news channel and the drama episodes, got:\n%s", data)
+	}
+}
+
+func TestXtreamAllowedGroups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	panel := newFakeXtreamPanel(t)
+	defer panel.Close()
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{
+			XtreamBaseURL:  panel.URL,
+			XtreamUser:     "user",
+			XtreamPassword: "pass",
+		},
+		users: newUserStore([]config.Account{
+			{Username: "alice", Password: "secret", AllowedGroups: []string{"News", "Drama"}},
+			{Username: "bob", Password: "secret", AllowedGroups: []string{"Sports"}},
+		}),
+		xtreamClients: xtreamapi.NewPool(nil),
+	}
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/player_api.php", nil)
+	client, err := c.xtreamClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := c.users.get("alice")
+
+	// An episode is known from the infos of its series
+	if allowed, err := client.Allowed(alice, "episode", "417904"); err != nil || allowed {
+		t.Errorf("Expected an episode of unknown series to be refused, got %t: %v", allowed, err)
+	}
+	if _, err := client.GetSeriesInfo("31"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		streamType, id string
+		want           bool
+	}{
+		{"live", "11", true},
+		{"vod", "21", false},
+		{"series", "31", true},
+		{"episode", "417904", true},
+		{"episode", "1", false},
+	} {
+		if allowed, err := client.Allowed(alice, tc.streamType, tc.id); err != nil || allowed != tc.want {
+			t.Errorf("%s %s: expected allowed %t, got %t: %v", tc.streamType, tc.id, tc.want, allowed, err)
+		}
+	}
+
+	router := gin.New()
+	c.xtreamStreamRoutes(router.Group("/"))
+	router.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
+
+	for _, path := range []string{
+		"/bob/secret/11.ts",
+		"/live/bob/secret/11.ts",
+		"/timeshift/bob/secret/60/2026-01-01:12-00/11.ts",
+		"/movie/bob/secret/21.mp4",
+		"/series/bob/secret/417904.mkv",
+		"/player_api.php?username=bob&password=secret&action=get_vod_info&vod_id=21",
+		"/player_api.php?username=bob&password=secret&action=get_series_info&series_id=31",
+		"/player_api.php?username=bob&password=secret&action=get_short_epg&stream_id=11",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected %s to be forbidden, got status %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package ssdp announces a UPnP device on the LAN with the Simple Service Discovery Protocol.
+//
+// The responder answers the M-SEARCH requests matching the device and periodically
+// multicasts NOTIFY ssdp:alive announcements, followed by ssdp:byebye when it stops.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAddr is the SSDP multicast group
+const DefaultAddr = "239.255.255.250:1900"
+
+const (
+	rootDevice = "upnp:rootdevice"
+	searchAll  = "ssdp:all"
+	// maxResponseDelay caps the random delay asked by the MX header of M-SEARCH requests
+	maxResponseDelay = time.Second
+)
+
+// Device is the announced UPnP device
+type Device struct {
+	// UDN is the unique device name e.g: "uuid:2f402f80-da50-11e1-9b23-001788255acc"
+	UDN string
+	// Location is the url of the device description
+	Location string
+	// Types are the device and service types e.g: "urn:schemas-upnp-org:device:MediaServer:1"
+	Types []string
+	// Server is the SERVER header e.g: "iptv-proxy UPnP/1.0"
+	Server string
+	// MaxAge is the validity of the announcements, 30 minutes if zero
+	MaxAge time.Duration
+}
+
+// Responder announces a device on an SSDP address
+type Responder struct {
+	device Device
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+
+	// NotifyAddr receives the NOTIFY announcements, the listening address by default
+	NotifyAddr *net.UDPAddr
+}
+
+// Listen returns a responder for the device on addr, a multicast group (DefaultAddr on the LAN)
+// or a unicast address.
+func Listen(addr string, device Device) (*Responder, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if udpAddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp4", udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if device.MaxAge == 0 {
+		device.MaxAge = 30 * time.Minute
+	}
+
+	return &Responder{
+		device:     device,
+		conn:       conn,
+		group:      udpAddr,
+		NotifyAddr: udpAddr,
+	}, nil
+}
+
+// LocalAddr returns the listening address
+func (r *Responder) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Serve answers the searches and sends the announcements until ctx is done.
+func (r *Responder) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		r.notify("ssdp:byebye")
+		r.conn.Close()
+	}()
+
+	go r.announce(ctx)
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+
+		targets := r.searchTargets(req.Header.Get("ST"))
+		if len(targets) == 0 {
+			continue
+		}
+
+		go r.respond(from, targets, responseDelay(req.Header.Get("MX")))
+	}
+}
+
+// announce sends the alive announcements at half the max age
+func (r *Responder) announce(ctx context.Context) {
+	ticker := time.NewTicker(r.device.MaxAge / 2)
+	defer ticker.Stop()
+
+	r.notify("ssdp:alive")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.notify("ssdp:alive")
+		}
+	}
+}
+
+// notificationTypes returns every type the device is announced as
+func (r *Responder) notificationTypes() []string {
+	return append([]string{rootDevice, r.device.UDN}, r.device.Types...)
+}
+
+// searchTargets returns the types of the device matching a search target
+func (r *Responder) searchTargets(st string) []string {
+	if st == searchAll {
+		return r.notificationTypes()
+	}
+
+	for _, nt := range r.notificationTypes() {
+		if nt == st {
+			return []string{st}
+		}
+	}
+
+	return nil
+}
+
+// usn returns the unique service name of the device for a type
+func (r *Responder) usn(nt string) string {
+	if nt == r.device.UDN {
+		return nt
+	}
+	return r.device.UDN + "::" + nt
+}
+
+func (r *Responder) notify(nts string) {
+	for _, nt := range r.notificationTypes() {
+		msg := fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"LOCATION: %s\r\n"+
+			"NT: %s\r\n"+
+			"NTS: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			r.group, int(r.device.MaxAge.Seconds()), r.device.Location, nt, nts, r.device.Server, r.usn(nt))
+
+		if _, err := r.conn.WriteToUDP([]byte(msg), r.NotifyAddr); err != nil {
+			log.Printf("[ssdp] Unable to send %s notification: %v", nts, err)
+			return
+		}
+	}
+}
+
+func (r *Responder) respond(to *net.UDPAddr, targets []string, delay time.Duration) {
+	time.Sleep(delay)
+
+	for _, st := range targets {
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"DATE: %s\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			int(r.device.MaxAge.Seconds()), time.Now().UTC().Format(http.TimeFormat), r.device.Location, r.device.Server, st, r.usn(st))
+
+		if _, err := r.conn.WriteToUDP([]byte(msg), to); err != nil {
+			log.Printf("[ssdp] Unable to answer search from %s: %v", to, err)
+			return
+		}
+	}
+}
+
+// responseDelay returns a random delay within the MX seconds of a search
+func responseDelay(mx string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(mx))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	max := time.Duration(seconds) * time.Second
+	if max > maxResponseDelay {
+		max = maxResponseDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
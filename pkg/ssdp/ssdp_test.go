@@ -0,0 +1,96 @@
+package ssdp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMessages(t *testing.T, conn *net.UDPConn, n int) []string {
+	t.Helper()
+
+	messages := make([]string, 0, n)
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second)) // nolint: errcheck
+	for len(messages) < n {
+		size, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Expected %d messages, got %d: %v", n, len(messages), err)
+		}
+		messages = append(messages, string(buf[:size]))
+	}
+
+	return messages
+}
+
+func TestResponder(t *testing.T) {
+	device := Device{
+		UDN:      "uuid:01234567-89ab-cdef-0123-456789abcdef",
+		Location: "http://proxy.lan:8080/device.xml",
+		Types:    []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+		Server:   "iptv-proxy UPnP/1.0",
+	}
+
+	responder, err := Listen("127.0.0.1:0", device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	responder.NotifyAddr = client.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- responder.Serve(ctx)
+	}()
+
+	// The device is announced on start
+	for _, msg := range readMessages(t, client, 3) {
+		if !strings.HasPrefix(msg, "NOTIFY * HTTP/1.1\r\n") || !strings.Contains(msg, "NTS: ssdp:alive\r\n") ||
+			!strings.Contains(msg, "LOCATION: http://proxy.lan:8080/device.xml\r\n") {
+			t.Errorf("Unexpected announcement:\n%s", msg)
+		}
+	}
+
+	search := func(st string) {
+		msg := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: " + st + "\r\n\r\n"
+		if _, err := client.WriteToUDP([]byte(msg), responder.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search("urn:schemas-upnp-org:device:MediaServer:1")
+	msg := readMessages(t, client, 1)[0]
+	if !strings.HasPrefix(msg, "HTTP/1.1 200 OK\r\n") ||
+		!strings.Contains(msg, "ST: urn:schemas-upnp-org:device:MediaServer:1\r\n") ||
+		!strings.Contains(msg, "USN: "+device.UDN+"::urn:schemas-upnp-org:device:MediaServer:1\r\n") {
+		t.Errorf("Unexpected search response:\n%s", msg)
+	}
+
+	// Searches for other devices are ignored
+	search("urn:schemas-upnp-org:device:Printer:1")
+	search("ssdp:all")
+	responses := readMessages(t, client, 3)
+	for _, msg := range responses {
+		if strings.Contains(msg, "Printer") {
+			t.Errorf("Unexpected response to another device search:\n%s", msg)
+		}
+	}
+
+	cancel()
+	for _, msg := range readMessages(t, client, 3) {
+		if !strings.Contains(msg, "NTS: ssdp:byebye\r\n") {
+			t.Errorf("Expected byebye, got:\n%s", msg)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected serve error: %v", err)
+	}
+}
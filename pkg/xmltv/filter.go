@@ -0,0 +1,160 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xmltv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FilterOptions select the channels and programmes copied by Filter
+type FilterOptions struct {
+	// Channel reports whether the channel id is kept, all the channels are kept if nil
+	Channel func(id string) bool
+	// From drops the programmes ended before it, if not zero
+	From time.Time
+	// To drops the programmes starting after it, if not zero
+	To time.Time
+	// Offset returns the shift of the programme times of the channel id, if not nil
+	Offset func(channel string) time.Duration
+}
+
+// Filter copies the XMLTV document r, gzip compressed or not, to w keeping only the
+// channels and programmes selected by opts. The document is streamed, never loaded in memory.
+func Filter(w io.Writer, r io.Reader, opts FilterOptions) error {
+	r, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(r)
+	e := xml.NewEncoder(w)
+
+	depth := 0
+	skipped := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid xmltv: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 1 {
+				t = opts.shift(t)
+				tok = t
+			}
+			if depth == 1 && !opts.keep(t) {
+				if err := d.Skip(); err != nil {
+					return fmt.Errorf("invalid xmltv: %v", err)
+				}
+				skipped = true
+				continue
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			// Drop the indentation of the dropped elements
+			if skipped && len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		}
+		skipped = false
+
+		if err := e.EncodeToken(tok); err != nil {
+			return err
+		}
+	}
+
+	return e.Flush()
+}
+
+func (o FilterOptions) keep(e xml.StartElement) bool {
+	switch e.Name.Local {
+	case "channel":
+		return o.Channel == nil || o.Channel(attr(e, "id"))
+	case "programme":
+		if o.Channel != nil && !o.Channel(attr(e, "channel")) {
+			return false
+		}
+
+		start, stop := parseTime(attr(e, "start")), parseTime(attr(e, "stop"))
+		if stop.IsZero() {
+			stop = start
+		}
+		if !o.From.IsZero() && !stop.IsZero() && stop.Before(o.From) {
+			return false
+		}
+		if !o.To.IsZero() && !start.IsZero() && start.After(o.To) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// shift returns the programme e with its times shifted by the offset of its channel.
+func (o FilterOptions) shift(e xml.StartElement) xml.StartElement {
+	if e.Name.Local != "programme" || o.Offset == nil {
+		return e
+	}
+	offset := o.Offset(attr(e, "channel"))
+	if offset == 0 {
+		return e
+	}
+
+	attrs := make([]xml.Attr, len(e.Attr))
+	copy(attrs, e.Attr)
+	for i, a := range attrs {
+		if a.Name.Local != "start" && a.Name.Local != "stop" {
+			continue
+		}
+		if t := parseTime(a.Value); !t.IsZero() {
+			attrs[i].Value = t.Add(offset).Format(TimeLayout)
+		}
+	}
+	e.Attr = attrs
+
+	return e
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// parseTime returns the time of an XMLTV attribute value, zero if invalid.
+func parseTime(value string) time.Time {
+	var t Time
+	t.UnmarshalXMLAttr(xml.Attr{Value: value}) // nolint: errcheck
+
+	return t.Time
+}
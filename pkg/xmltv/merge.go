@@ -0,0 +1,167 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xmltv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Source is an XMLTV document merged by Merge
+type Source struct {
+	// Name identifies the source in the errors
+	Name   string
+	Reader io.Reader
+	// Aliases maps channel ids of the source to the ids of the merged guide
+	Aliases map[string]string
+}
+
+// element is a channel or a programme copied as is, only its id is rewritten.
+type element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+func (e *element) rewrite(name string, aliases map[string]string) string {
+	for i, a := range e.Attrs {
+		if a.Name.Local != name {
+			continue
+		}
+		if alias, ok := aliases[a.Value]; ok {
+			e.Attrs[i].Value = alias
+		}
+		return e.Attrs[i].Value
+	}
+
+	return ""
+}
+
+// Merge writes to w the XMLTV documents of sources, gzip compressed or not, merged into one guide.
+// The sources come by precedence: a channel is taken from the first source defining it and
+// its programmes from the first source having programmes for it.
+// The programmes are held in scratch while the channels are collected, as the channels come first.
+// A source that can't be read is kept up to the failing element, its error is returned once the
+// guide is written.
+func Merge(w io.Writer, scratch io.ReadWriteSeeker, sources ...Source) error {
+	channels := &bytes.Buffer{}
+	channelsEnc := xml.NewEncoder(channels)
+	programmesEnc := xml.NewEncoder(scratch)
+
+	seen := make(map[string]bool)
+	covered := make(map[string]bool)
+	var errs []string
+
+	for _, src := range sources {
+		found, err := mergeSource(channelsEnc, programmesEnc, src, seen, covered)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.Name, err))
+		}
+		for id := range found {
+			covered[id] = true
+		}
+	}
+
+	if err := channelsEnc.Flush(); err != nil {
+		return err
+	}
+	if err := programmesEnc.Flush(); err != nil {
+		return err
+	}
+	if _, err := scratch.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, xml.Header+`<tv generator-info-name="iptv-proxy">`); err != nil {
+		return err
+	}
+	if _, err := channels.WriteTo(w); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, scratch); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\n</tv>\n"); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid xmltv %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// mergeSource copies the channels not seen yet and the programmes of the channels not covered yet,
+// it returns the channels the source has programmes for.
+func mergeSource(channels, programmes *xml.Encoder, src Source, seen, covered map[string]bool) (map[string]bool, error) {
+	found := make(map[string]bool)
+
+	r, err := NewReader(src.Reader)
+	if err != nil {
+		return found, err
+	}
+
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return found, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "channel" && start.Name.Local != "programme") {
+			continue
+		}
+
+		var e element
+		if err := d.DecodeElement(&e, &start); err != nil {
+			return found, err
+		}
+
+		enc := programmes
+		if start.Name.Local == "channel" {
+			id := e.rewrite("id", src.Aliases)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			enc = channels
+		} else {
+			id := e.rewrite("channel", src.Aliases)
+			if covered[id] {
+				continue
+			}
+			found[id] = true
+		}
+
+		if err := enc.EncodeToken(xml.CharData("\n  ")); err != nil {
+			return found, err
+		}
+		if err := enc.Encode(e); err != nil {
+			return found, err
+		}
+	}
+}
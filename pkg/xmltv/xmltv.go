@@ -0,0 +1,214 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package xmltv reads XMLTV electronic program guides.
+package xmltv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the layout of the XMLTV programme times
+const TimeLayout = "20060102150405 -0700"
+
+// Guide is an XMLTV document
+type Guide struct {
+	XMLName    xml.Name    `xml:"tv"`
+	Channels   []Channel   `xml:"channel"`
+	Programmes []Programme `xml:"programme"`
+}
+
+// Channel is an XMLTV channel
+type Channel struct {
+	ID           string `xml:"id,attr"`
+	DisplayNames []Text `xml:"display-name"`
+	Icons        []Icon `xml:"icon"`
+}
+
+// Programme is an XMLTV programme
+type Programme struct {
+	Channel      string `xml:"channel,attr"`
+	Start        Time   `xml:"start,attr"`
+	Stop         Time   `xml:"stop,attr"`
+	Titles       []Text `xml:"title"`
+	Descriptions []Text `xml:"desc"`
+}
+
+// Text is a translated text
+type Text struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// Icon is an image
+type Icon struct {
+	Src string `xml:"src,attr"`
+}
+
+// Time is an XMLTV time attribute
+type Time struct {
+	time.Time
+}
+
+// UnmarshalXMLAttr parses an XMLTV time, the timezone is optional
+func (t *Time) UnmarshalXMLAttr(attr xml.Attr) error {
+	value := strings.TrimSpace(attr.Value)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := time.Parse(TimeLayout, value)
+	if err != nil {
+		if len(value) < 14 {
+			return fmt.Errorf("invalid xmltv time %q", value)
+		}
+		parsed, err = time.Parse("20060102150405", value[:14])
+		if err != nil {
+			return fmt.Errorf("invalid xmltv time %q: %v", value, err)
+		}
+	}
+	t.Time = parsed
+
+	return nil
+}
+
+// MarshalXMLAttr formats an XMLTV time
+func (t Time) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if t.IsZero() {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: name, Value: t.Format(TimeLayout)}, nil
+}
+
+// Title returns the first title of the programme
+func (p Programme) Title() Text {
+	if len(p.Titles) == 0 {
+		return Text{}
+	}
+	return p.Titles[0]
+}
+
+// Description returns the first description of the programme
+func (p Programme) Description() Text {
+	if len(p.Descriptions) == 0 {
+		return Text{}
+	}
+	return p.Descriptions[0]
+}
+
+// NewReader returns a reader of the XMLTV document r, decompressed if it is gzip compressed
+func NewReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+
+	return br, nil
+}
+
+// Parse reads an XMLTV document, gzip compressed or not
+func Parse(r io.Reader) (*Guide, error) {
+	r, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	guide := &Guide{}
+	if err := xml.NewDecoder(r).Decode(guide); err != nil {
+		return nil, fmt.Errorf("invalid xmltv: %v", err)
+	}
+
+	return guide, nil
+}
+
+// ReadProgrammes streams the programmes of the XMLTV document r, gzip compressed or not, to fn.
+// The document is never loaded in memory.
+func ReadProgrammes(r io.Reader, fn func(Programme)) error {
+	r, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid xmltv: %v", err)
+		}
+
+		e, ok := tok.(xml.StartElement)
+		if !ok || e.Name.Local != "programme" {
+			continue
+		}
+		var p Programme
+		if err := d.DecodeElement(&p, &e); err != nil {
+			return fmt.Errorf("invalid xmltv: %v", err)
+		}
+		fn(p)
+	}
+}
+
+// Load reads an XMLTV document from an url or a file
+func Load(source string) (*Guide, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return Parse(f)
+	}
+
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("xmltv %s returned status %d", source, resp.StatusCode)
+	}
+
+	return Parse(resp.Body)
+}
+
+// ChannelProgrammes returns the programmes of a channel sorted by start time
+func (g *Guide) ChannelProgrammes(channelID string) []Programme {
+	programmes := make([]Programme, 0)
+	for _, p := range g.Programmes {
+		if p.Channel == channelID {
+			programmes = append(programmes, p)
+		}
+	}
+	sort.SliceStable(programmes, func(i, j int) bool { return programmes[i].Start.Before(programmes[j].Start.Time) })
+
+	return programmes
+}
@@ -0,0 +1,192 @@
+package xmltv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGuide = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <channel id="one.tv"><display-name>One</display-name><icon src="http://logo/one.png"/></channel>
+  <programme channel="one.tv" start="20260101130000 +0100" stop="20260101140000 +0100">
+    <title lang="en">Second</title>
+  </programme>
+  <programme channel="one.tv" start="20260101110000" stop="20260101120000">
+    <title lang="en">First</title>
+    <desc lang="en">The first one</desc>
+  </programme>
+  <programme channel="two.tv" start="20260101110000 +0000" stop="20260101120000 +0000">
+    <title>Other</title>
+  </programme>
+</tv>`
+
+func TestParse(t *testing.T) {
+	guide, err := Parse(strings.NewReader(testGuide))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(guide.Channels) != 1 || guide.Channels[0].ID != "one.tv" || guide.Channels[0].Icons[0].Src != "http://logo/one.png" {
+		t.Errorf("Unexpected channels %+v", guide.Channels)
+	}
+
+	programmes := guide.ChannelProgrammes("one.tv")
+	if len(programmes) != 2 {
+		t.Fatalf("Expected 2 programmes, got %d", len(programmes))
+	}
+	first := programmes[0]
+	if first.Title().Value != "First" || first.Description().Value != "The first one" || first.Title().Lang != "en" {
+		t.Errorf("Unexpected first programme %+v", first)
+	}
+	if !first.Start.Equal(time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected a time without timezone to be UTC, got %v", first.Start)
+	}
+	if !programmes[1].Start.Equal(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected second programme start %v", programmes[1].Start)
+	}
+}
+
+func TestReadProgrammes(t *testing.T) {
+	var titles []string
+	err := ReadProgrammes(strings.NewReader(testGuide), func(p Programme) {
+		titles = append(titles, p.Channel+":"+p.Title().Value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(titles, ",") != "one.tv:Second,one.tv:First,two.tv:Other" {
+		t.Errorf("Unexpected programmes %v", titles)
+	}
+
+	if err := ReadProgrammes(strings.NewReader("<tv><programme>"), func(Programme) {}); err == nil {
+		t.Error("Expected an error on a truncated guide")
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(testGuide)) // nolint: errcheck
+	gz.Close()
+
+	guide, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(guide.Programmes) != 3 {
+		t.Errorf("Expected 3 programmes, got %d", len(guide.Programmes))
+	}
+}
+
+func TestFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Filter(out, strings.NewReader(testGuide), FilterOptions{
+		Channel: func(id string) bool { return id == "one.tv" },
+		From:    time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guide, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Invalid filtered guide: %v\n%s", err, out)
+	}
+	if len(guide.Channels) != 1 || len(guide.Programmes) != 1 || guide.Programmes[0].Title().Value != "Second" {
+		t.Errorf("Unexpected filtered guide %+v", guide)
+	}
+
+	out.Reset()
+	if err := Filter(out, strings.NewReader(testGuide), FilterOptions{To: time.Date(2026, 1, 1, 11, 30, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), `<?xml version="1.0" encoding="UTF-8"?>`) {
+		t.Errorf("Expected the xml declaration to be kept, got %q", out.String())
+	}
+	if guide, err = Parse(out); err != nil || len(guide.Programmes) != 2 || guide.Programmes[1].Channel != "two.tv" {
+		t.Errorf("Expected the programmes starting before 11:30, got %+v: %v", guide, err)
+	}
+}
+
+func TestFilterOffset(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Filter(out, strings.NewReader(testGuide), FilterOptions{
+		Offset: func(channel string) time.Duration {
+			if channel == "one.tv" {
+				return -time.Hour
+			}
+			return 0
+		},
+		// Applies to the shifted times
+		From: time.Date(2026, 1, 1, 11, 30, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `start="20260101120000 +0100" stop="20260101130000 +0100"`) {
+		t.Errorf("Expected the timezone of the shifted programme to be kept, got %s", out)
+	}
+
+	guide, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Invalid shifted guide: %v\n%s", err, out)
+	}
+	if len(guide.Programmes) != 2 || guide.Programmes[0].Title().Value != "Second" || !guide.Programmes[1].Start.Equal(time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the shifted first programme to be dropped and the other channel untouched, got %+v", guide.Programmes)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	other := `<tv>
+  <channel id="uno"><display-name>Uno</display-name></channel>
+  <channel id="three.tv"><display-name>Three</display-name></channel>
+  <programme channel="uno" start="20260101110000 +0000" stop="20260101120000 +0000"><title>Dropped</title></programme>
+  <programme channel="three.tv" start="20260101110000 +0000" stop="20260101120000 +0000"><title>Third &amp; last</title></programme>
+</tv>`
+
+	scratch, err := ioutil.TempFile("", "xmltv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(scratch.Name())
+	defer scratch.Close()
+
+	out := &bytes.Buffer{}
+	err = Merge(out, scratch,
+		Source{Name: "main", Reader: strings.NewReader(testGuide)},
+		Source{Name: "other", Reader: strings.NewReader(other), Aliases: map[string]string{"uno": "one.tv"}},
+		Source{Name: "broken", Reader: strings.NewReader(`<tv><channel id="four.tv"></channel><programme`)},
+	)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Expected the broken source error, got %v", err)
+	}
+
+	guide, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Invalid merged guide: %v\n%s", err, out)
+	}
+
+	ids := make([]string, 0)
+	for _, c := range guide.Channels {
+		ids = append(ids, c.ID)
+	}
+	if strings.Join(ids, ",") != "one.tv,three.tv,four.tv" {
+		t.Errorf("Unexpected channels %v", ids)
+	}
+	if guide.Channels[0].DisplayNames[0].Value != "One" {
+		t.Errorf("Expected the channel of the first source, got %+v", guide.Channels[0])
+	}
+
+	if len(guide.ChannelProgrammes("one.tv")) != 2 {
+		t.Errorf("Expected the aliased programmes to be dropped, got %+v", guide.ChannelProgrammes("one.tv"))
+	}
+	if p := guide.ChannelProgrammes("three.tv"); len(p) != 1 || p[0].Title().Value != "Third & last" {
+		t.Errorf("Unexpected programmes of the second source %+v", p)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 )
 
 var defaultUserAgent = "go.xstream-codes (Go-http-client/1.1)"
@@ -29,7 +30,8 @@ type XtreamClient struct {
 	Context context.Context
 
 	// We store an internal map of Streams for use with GetStreamURL
-	streams map[int]Stream
+	streams      map[int]Stream
+	streamsMutex sync.RWMutex
 }
 
 // NewClient returns an initialized XtreamClient with the given values.
@@ -114,12 +116,13 @@ func (c *XtreamClient) GetStreamURL(streamID int, wantedFormat string) (string,
 		return "", fmt.Errorf("%s is not an allowed output format", wantedFormat)
 	}
 
-	if _, ok := c.streams[streamID]; !ok {
+	c.streamsMutex.RLock()
+	stream, ok := c.streams[streamID]
+	c.streamsMutex.RUnlock()
+	if !ok {
 		return "", fmt.Errorf("%d is not a valid stream id", streamID)
 	}
 
-	stream := c.streams[streamID]
-
 	return fmt.Sprintf("%s/%s/%s/%s/%d.%s", c.BaseURL, stream.Type, c.Username, c.Password, stream.ID, wantedFormat), nil
 }
 
@@ -194,9 +197,11 @@ func (c *XtreamClient) GetStreams(streamAction, categoryID string) ([]Stream, er
 		return nil, jsonErr
 	}
 
+	c.streamsMutex.Lock()
 	for _, stream := range streams {
 		c.streams[int(stream.ID)] = stream
 	}
+	c.streamsMutex.Unlock()
 
 	return streams, nil
 }
@@ -0,0 +1,261 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTLs are the durations the provider responses are cached for, by action.
+// The actions missing here, like the login, are not cached.
+var DefaultCacheTTLs = map[string]time.Duration{
+	getLiveCategories:   6 * time.Hour,
+	getVodCategories:    6 * time.Hour,
+	getSeriesCategories: 6 * time.Hour,
+	getLiveStreams:      time.Hour,
+	getVodStreams:       time.Hour,
+	getSeries:           time.Hour,
+	getVodInfo:          6 * time.Hour,
+	getSerieInfo:        6 * time.Hour,
+	getShortEPG:         5 * time.Minute,
+	getSimpleDataTable:  30 * time.Minute,
+}
+
+// clientMaxAge is the duration an authenticated client is reused for,
+// its user and server infos are refreshed after.
+const clientMaxAge = time.Hour
+
+// cachedResponse is a provider response shared by the requests of the same action and parameters.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (r *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+		Request:       req,
+	}
+}
+
+// flight is a provider request in progress, waited for by the identical requests.
+type flight struct {
+	done chan struct{}
+	resp *cachedResponse
+	err  error
+}
+
+// ResponseCache caches the player_api.php responses of the provider and
+// coalesces the identical concurrent requests into one.
+type ResponseCache struct {
+	mutex     sync.Mutex
+	ttls      map[string]time.Duration
+	entries   map[string]*cachedResponse
+	flights   map[string]*flight
+	lastSweep time.Time
+}
+
+// NewResponseCache returns a cache using DefaultCacheTTLs, overridden by ttls.
+// A zero duration disables the cache of the action.
+func NewResponseCache(ttls map[string]time.Duration) *ResponseCache {
+	merged := make(map[string]time.Duration, len(DefaultCacheTTLs)+len(ttls))
+	for action, ttl := range DefaultCacheTTLs {
+		merged[action] = ttl
+	}
+	for action, ttl := range ttls {
+		merged[action] = ttl
+	}
+
+	return &ResponseCache{
+		ttls:      merged,
+		entries:   make(map[string]*cachedResponse),
+		flights:   make(map[string]*flight),
+		lastSweep: time.Now(),
+	}
+}
+
+// Transport returns a RoundTripper answering the player_api.php requests from the cache,
+// next is used for the other requests and the cache misses.
+func (c *ResponseCache) Transport(next http.RoundTripper) http.RoundTripper {
+	return &cacheTransport{cache: c, next: next}
+}
+
+type cacheTransport struct {
+	cache *ResponseCache
+	next  http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || path.Base(req.URL.Path) != "player_api.php" {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.cache.do(req.URL.String(), req.URL.Query().Get("action"), func() (*cachedResponse, error) {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cachedResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.response(req), nil
+}
+
+// do returns the cached response of key, or the response of fetch, the identical
+// requests arriving meanwhile wait for it. Only the successful responses are cached.
+func (c *ResponseCache) do(key, action string, fetch func() (*cachedResponse, error)) (*cachedResponse, error) {
+	c.mutex.Lock()
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) {
+		c.mutex.Unlock()
+		return entry, nil
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mutex.Unlock()
+		<-f.done
+		return f.resp, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mutex.Unlock()
+
+	f.resp, f.err = fetch()
+
+	c.mutex.Lock()
+	delete(c.flights, key)
+	if ttl := c.ttls[action]; ttl > 0 && f.err == nil && f.resp.status == http.StatusOK {
+		f.resp.expires = time.Now().Add(ttl)
+		c.entries[key] = f.resp
+	}
+	c.sweep()
+	c.mutex.Unlock()
+	close(f.done)
+
+	return f.resp, f.err
+}
+
+// sweep removes the expired responses, at most once a minute.
+// The caller must hold the lock.
+func (c *ResponseCache) sweep() {
+	now := time.Now()
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Pool reuses an authenticated client per provider account, whatever the user agent of the requests,
+// their player_api.php requests go through the response cache.
+type Pool struct {
+	mutex   sync.Mutex
+	cache   *ResponseCache
+	http    *http.Client
+	clients map[string]*pooledClient
+}
+
+// pooledClient is the client of an account, its mutex serializes the logins of the account.
+type pooledClient struct {
+	sync.Mutex
+	*Client
+	created time.Time
+}
+
+// NewPool returns a pool whose clients share a response cache using ttls, see NewResponseCache.
+func NewPool(ttls map[string]time.Duration) *Pool {
+	cache := NewResponseCache(ttls)
+
+	return &Pool{
+		cache:   cache,
+		http:    &http.Client{Transport: cache.Transport(http.DefaultTransport)},
+		clients: make(map[string]*pooledClient),
+	}
+}
+
+// Get returns the client of the account, authenticated once per clientMaxAge
+// with the user agent of the request renewing it.
+// The logins of an account are serialized, so concurrent requests don't authenticate twice,
+// a slow login doesn't hold the requests of the other accounts.
+// A nil pool returns a new client.
+func (p *Pool) Get(user, password, baseURL, userAgent string) (*Client, error) {
+	if p == nil {
+		return New(user, password, baseURL, userAgent)
+	}
+
+	key := user + "\x00" + password + "\x00" + baseURL
+
+	p.mutex.Lock()
+	pooled, ok := p.clients[key]
+	if !ok {
+		pooled = &pooledClient{}
+		p.clients[key] = pooled
+	}
+	p.mutex.Unlock()
+
+	pooled.Lock()
+	defer pooled.Unlock()
+
+	if pooled.Client != nil && time.Since(pooled.created) < clientMaxAge {
+		return pooled.Client, nil
+	}
+
+	cli, err := New(user, password, baseURL, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	cli.HTTP = p.http
+	if pooled.Client != nil {
+		cli.episodes = pooled.Client.episodes
+	}
+
+	pooled.Client = cli
+	pooled.created = time.Now()
+
+	return cli, nil
+}
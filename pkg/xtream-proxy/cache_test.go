@@ -0,0 +1,134 @@
+package xtreamproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	var logins, categories, streams int32
+	release := make(chan struct{})
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("action") {
+		case "":
+			atomic.AddInt32(&logins, 1)
+			w.Write([]byte(`{"user_info":{"username":"user","password":"pass","auth":1},"server_info":{}}`)) // nolint: errcheck
+		case getLiveCategories:
+			atomic.AddInt32(&categories, 1)
+			<-release
+			w.Write([]byte(`[{"category_id":"1","category_name":"News","parent_id":0}]`)) // nolint: errcheck
+		case getLiveStreams:
+			atomic.AddInt32(&streams, 1)
+			w.Write([]byte(`[]`)) // nolint: errcheck
+		}
+	}))
+	defer panel.Close()
+
+	pool := NewPool(map[string]time.Duration{getLiveStreams: 0})
+
+	client, err := pool.Get("user", "pass", panel.URL, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pool.Get("user", "pass", panel.URL, "agent"); again != client {
+		t.Error("Expected the authenticated client to be reused")
+	}
+	if other, _ := pool.Get("user", "pass", panel.URL, "other agent"); other != client || len(pool.clients) != 1 {
+		t.Errorf("Expected a single client whatever the user agent, got %d", len(pool.clients))
+	}
+	if atomic.LoadInt32(&logins) != 1 {
+		t.Errorf("Expected a single login, got %d", logins)
+	}
+
+	// Identical concurrent requests are coalesced, then served from the cache
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cats, err := client.GetLiveCategories()
+			if err != nil || len(cats) != 1 || cats[0].Name != "News" {
+				t.Errorf("Unexpected categories %+v: %v", cats, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if _, err := client.GetLiveCategories(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&categories); n != 1 {
+		t.Errorf("Expected a single categories request, got %d", n)
+	}
+
+	// The cache of an action can be disabled
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetLiveStreams(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&streams); n != 2 {
+		t.Errorf("Expected the streams not to be cached, got %d requests", n)
+	}
+}
+
+func TestPoolSlowLogin(t *testing.T) {
+	release := make(chan struct{})
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("username") == "slow" {
+			<-release
+		}
+		w.Write([]byte(`{"user_info":{"auth":1},"server_info":{}}`)) // nolint: errcheck
+	}))
+	defer panel.Close()
+	defer close(release)
+
+	pool := NewPool(nil)
+	go pool.Get("slow", "pass", panel.URL, "agent") // nolint: errcheck
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := pool.Get("user", "pass", panel.URL, "agent")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the login of an account not to wait for the slow login of another one")
+	}
+}
+
+func TestResponseCacheErrors(t *testing.T) {
+	var requests int32
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer panel.Close()
+
+	client := &http.Client{Transport: NewResponseCache(nil).Transport(http.DefaultTransport)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(panel.URL + "/player_api.php?action=" + getLiveCategories)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected the provider status, got %d", resp.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected the errors not to be cached, got %d requests", n)
+	}
+}
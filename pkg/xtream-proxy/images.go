@@ -0,0 +1,67 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	xtream "github.com/incmve/iptv-proxy/pkg/xtream-codes-fixed"
+)
+
+// RewriteImages rewrites the image urls (stream_icon, cover, movie_image, backdrop_path)
+// of a response returned by Action.
+func RewriteImages(resp interface{}, rewrite func(string) string) {
+	switch r := resp.(type) {
+	case []xtream.Stream:
+		for i := range r {
+			r[i].Icon = rewrite(r[i].Icon)
+		}
+	case []xtream.SeriesInfo:
+		for i := range r {
+			rewriteSeriesInfo(&r[i], rewrite)
+		}
+	case *xtream.Series:
+		if r == nil {
+			return
+		}
+		rewriteSeriesInfo(&r.Info, rewrite)
+		for _, episodes := range r.Episodes {
+			for i := range episodes {
+				episodes[i].Info.MovieImage = rewrite(episodes[i].Info.MovieImage)
+			}
+		}
+	case *xtream.VideoOnDemandInfo:
+		if r == nil {
+			return
+		}
+		r.Info.MovieImage = rewrite(r.Info.MovieImage)
+		rewriteAll(r.Info.BackdropPath, rewrite)
+	}
+}
+
+func rewriteSeriesInfo(info *xtream.SeriesInfo, rewrite func(string) string) {
+	info.Cover = rewrite(info.Cover)
+	if info.BackdropPath != nil {
+		rewriteAll(info.BackdropPath.Slice, rewrite)
+	}
+}
+
+func rewriteAll(urls []string, rewrite func(string) string) {
+	for i := range urls {
+		urls[i] = rewrite(urls[i])
+	}
+}
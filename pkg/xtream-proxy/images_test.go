@@ -0,0 +1,49 @@
+package xtreamproxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	xtream "github.com/incmve/iptv-proxy/pkg/xtream-codes-fixed"
+)
+
+func TestRewriteImages(t *testing.T) {
+	rewrite := func(s string) string {
+		if s == "" {
+			return s
+		}
+		return "proxy:" + s
+	}
+
+	streams := []xtream.Stream{{Icon: "http://panel/one.png"}, {}}
+	RewriteImages(streams, rewrite)
+	if streams[0].Icon != "proxy:http://panel/one.png" || streams[1].Icon != "" {
+		t.Errorf("Unexpected stream icons %+v", streams)
+	}
+
+	series := &xtream.Series{}
+	err := json.Unmarshal([]byte(`{
+		"info": {"cover": "http://panel/cover.png", "backdrop_path": "http://panel/backdrop.png"},
+		"episodes": {"1": [{"id": "1", "info": {"movie_image": "http://panel/episode.png"}}]}
+	}`), series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RewriteImages(series, rewrite)
+	if series.Info.Cover != "proxy:http://panel/cover.png" || series.Info.BackdropPath.Slice[0] != "proxy:http://panel/backdrop.png" ||
+		series.Episodes["1"][0].Info.MovieImage != "proxy:http://panel/episode.png" {
+		t.Errorf("Unexpected series images %+v", series)
+	}
+
+	vod := &xtream.VideoOnDemandInfo{}
+	vod.Info.MovieImage = "http://panel/movie.png"
+	vod.Info.BackdropPath = []string{"http://panel/backdrop.png"}
+	RewriteImages(vod, rewrite)
+	if vod.Info.MovieImage != "proxy:http://panel/movie.png" || vod.Info.BackdropPath[0] != "proxy:http://panel/backdrop.png" {
+		t.Errorf("Unexpected vod images %+v", vod.Info)
+	}
+
+	// Other responses are left untouched
+	RewriteImages([]xtream.Category{{Name: "News"}}, rewrite)
+	RewriteImages((*xtream.Series)(nil), rewrite)
+}
@@ -20,10 +20,12 @@ package xtreamproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 
 	"github.com/incmve/iptv-proxy/pkg/config"
 	xtream "github.com/incmve/iptv-proxy/pkg/xtream-codes-fixed"
@@ -42,9 +44,56 @@ const (
 	getSimpleDataTable  = "get_simple_data_table"
 )
 
+// ActionName returns the name of the action run for action, unknown actions are a login.
+func ActionName(action string) string {
+	switch action {
+	case getLiveCategories, getLiveStreams, getVodCategories, getVodStreams, getVodInfo,
+		getSeriesCategories, getSeries, getSerieInfo, getShortEPG, getSimpleDataTable:
+		return action
+	default:
+		return "login"
+	}
+}
+
+// ErrForbidden is returned for the streams of the categories the account can't access.
+var ErrForbidden = errors.New("stream not allowed for the account")
+
 // Client represent an xtream client
 type Client struct {
 	*xtream.XtreamClient
+	// series of the episodes whose series infos were fetched
+	episodes *episodeIndex
+}
+
+// episodeIndex maps the episode ids to the id of their series.
+type episodeIndex struct {
+	sync.Mutex
+	series map[string]string
+}
+
+func newEpisodeIndex() *episodeIndex {
+	return &episodeIndex{series: make(map[string]string)}
+}
+
+// add indexes the episodes of the series seriesID.
+func (x *episodeIndex) add(seriesID string, info *xtream.Series) {
+	x.Lock()
+	defer x.Unlock()
+
+	for _, episodes := range info.Episodes {
+		for _, episode := range episodes {
+			x.series[episode.ID] = seriesID
+		}
+	}
+}
+
+// lookup returns the series id of an episode, false if its series infos were never fetched.
+func (x *episodeIndex) lookup(episodeID string) (string, bool) {
+	x.Lock()
+	defer x.Unlock()
+
+	seriesID, ok := x.series[episodeID]
+	return seriesID, ok
 }
 
 // New new xtream client
@@ -54,7 +103,18 @@ func New(user, password, baseURL, userAgent string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{cli}, nil
+	return &Client{cli, newEpisodeIndex()}, nil
+}
+
+// GetSeriesInfo returns the infos of a series, its episodes are indexed to authorize their playback.
+func (c *Client) GetSeriesInfo(seriesID string) (*xtream.Series, error) {
+	info, err := c.XtreamClient.GetSeriesInfo(seriesID)
+	if err != nil {
+		return nil, err
+	}
+	c.episodes.add(seriesID, info)
+
+	return info, nil
 }
 
 type login struct {
@@ -63,17 +123,17 @@ type login struct {
 }
 
 // Login xtream login
-func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (login, error) {
+func (c *Client) login(account *config.Account, activeCons int, proxyURL string, proxyPort int, protocol string) (login, error) {
 	req := login{
 		UserInfo: xtream.UserInfo{
-			Username:             proxyUser,
-			Password:             proxyPassword,
+			Username:             account.Username.String(),
+			Password:             account.Password.String(),
 			Message:              c.UserInfo.Message,
 			Auth:                 c.UserInfo.Auth,
 			Status:               c.UserInfo.Status,
 			ExpDate:              c.UserInfo.ExpDate,
 			IsTrial:              c.UserInfo.IsTrial,
-			ActiveConnections:    c.UserInfo.ActiveConnections,
+			ActiveConnections:    xtream.FlexInt(activeCons),
 			CreatedAt:            c.UserInfo.CreatedAt,
 			MaxConnections:       c.UserInfo.MaxConnections,
 			AllowedOutputFormats: c.UserInfo.AllowedOutputFormats,
@@ -90,11 +150,18 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 		},
 	}
 
+	if !account.ExpDate.IsZero() {
+		req.UserInfo.ExpDate = &xtream.Timestamp{Time: account.ExpDate}
+	}
+	if account.MaxConnections > 0 {
+		req.UserInfo.MaxConnections = xtream.FlexInt(account.MaxConnections)
+	}
+
 	return req, nil
 }
 
-// Action execute an xtream action.
-func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
+// Action execute an xtream action for the proxy account.
+func (c *Client) Action(config *config.ProxyConfig, account *config.Account, activeCons int, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
 	protocol := "http"
 	if config.HTTPS {
 		protocol = "https"
@@ -102,40 +169,46 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 
 	switch action {
 	case getLiveCategories:
-		respBody, err = c.GetLiveCategories()
+		respBody, err = c.allowedCategories(account, "live")
 	case getLiveStreams:
 		categoryID := ""
 		if len(q["category_id"]) > 0 {
 			categoryID = q["category_id"][0]
 		}
-		respBody, err = c.GetLiveStreams(categoryID)
+		respBody, err = c.allowedStreams(account, "live", categoryID)
 	case getVodCategories:
-		respBody, err = c.GetVideoOnDemandCategories()
+		respBody, err = c.allowedCategories(account, "vod")
 	case getVodStreams:
 		categoryID := ""
 		if len(q["category_id"]) > 0 {
 			categoryID = q["category_id"][0]
 		}
-		respBody, err = c.GetVideoOnDemandStreams(categoryID)
+		respBody, err = c.allowedStreams(account, "vod", categoryID)
 	case getVodInfo:
 		httpcode, err = validateParams(q, "vod_id")
 		if err != nil {
 			return
 		}
+		if httpcode, err = c.checkAllowed(account, "vod", q["vod_id"][0]); err != nil {
+			return
+		}
 		respBody, err = c.GetVideoOnDemandInfo(q["vod_id"][0])
 	case getSeriesCategories:
-		respBody, err = c.GetSeriesCategories()
+		respBody, err = c.allowedCategories(account, "series")
 	case getSeries:
 		categoryID := ""
 		if len(q["category_id"]) > 0 {
 			categoryID = q["category_id"][0]
 		}
-		respBody, err = c.GetSeries(categoryID)
+		respBody, err = c.allowedSeries(account, categoryID)
 	case getSerieInfo:
 		httpcode, err = validateParams(q, "series_id")
 		if err != nil {
 			return
 		}
+		if httpcode, err = c.checkAllowed(account, "series", q["series_id"][0]); err != nil {
+			return
+		}
 		respBody, err = c.GetSeriesInfo(q["series_id"][0])
 	case getShortEPG:
 		limit := 0
@@ -151,20 +224,161 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 				return
 			}
 		}
+		if httpcode, err = c.checkAllowed(account, "live", q["stream_id"][0]); err != nil {
+			return
+		}
 		respBody, err = c.GetShortEPG(q["stream_id"][0], limit)
 	case getSimpleDataTable:
 		httpcode, err = validateParams(q, "stream_id")
 		if err != nil {
 			return
 		}
+		if httpcode, err = c.checkAllowed(account, "live", q["stream_id"][0]); err != nil {
+			return
+		}
 		respBody, err = c.GetEPG(q["stream_id"][0])
 	default:
-		respBody, err = c.login(config.User.String(), config.Password.String(), protocol+"://"+config.HostConfig.Hostname, config.AdvertisedPort, protocol)
+		respBody, err = c.login(account, activeCons, protocol+"://"+config.HostConfig.Hostname, config.AdvertisedPort, protocol)
 	}
 
 	return
 }
 
+// allowedCategories returns the categories of catType the account can access.
+func (c *Client) allowedCategories(account *config.Account, catType string) ([]xtream.Category, error) {
+	cats, err := c.GetCategories(catType)
+	if err != nil || len(account.AllowedGroups) == 0 {
+		return cats, err
+	}
+
+	allowed := make([]xtream.Category, 0, len(cats))
+	for _, cat := range cats {
+		if account.AllowGroup(cat.Name) {
+			allowed = append(allowed, cat)
+		}
+	}
+
+	return allowed, nil
+}
+
+// allowedCategoryIDs returns the ids of the categories of catType the account can access,
+// nil if the account can access all of them.
+func (c *Client) allowedCategoryIDs(account *config.Account, catType string) (map[int64]bool, error) {
+	if len(account.AllowedGroups) == 0 {
+		return nil, nil
+	}
+
+	cats, err := c.allowedCategories(account, catType)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int64]bool, len(cats))
+	for _, cat := range cats {
+		ids[int64(cat.ID)] = true
+	}
+
+	return ids, nil
+}
+
+// allowedStreams returns the live or vod streams the account can access.
+func (c *Client) allowedStreams(account *config.Account, streamType, categoryID string) ([]xtream.Stream, error) {
+	ids, err := c.allowedCategoryIDs(account, streamType)
+	if err != nil {
+		return nil, err
+	}
+
+	streams, err := c.GetStreams(streamType, categoryID)
+	if err != nil || ids == nil {
+		return streams, err
+	}
+
+	allowed := make([]xtream.Stream, 0, len(streams))
+	for _, stream := range streams {
+		if ids[int64(stream.CategoryID)] {
+			allowed = append(allowed, stream)
+		}
+	}
+
+	return allowed, nil
+}
+
+// allowedSeries returns the series the account can access.
+func (c *Client) allowedSeries(account *config.Account, categoryID string) ([]xtream.SeriesInfo, error) {
+	ids, err := c.allowedCategoryIDs(account, "series")
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := c.GetSeries(categoryID)
+	if err != nil || ids == nil {
+		return series, err
+	}
+
+	allowed := make([]xtream.SeriesInfo, 0, len(series))
+	for _, serie := range series {
+		if serie.CategoryID != nil && ids[int64(*serie.CategoryID)] {
+			allowed = append(allowed, serie)
+		}
+	}
+
+	return allowed, nil
+}
+
+// Allowed reports whether the account can access the stream id of streamType: "live", "vod",
+// "series" or "episode" for an episode of a series, from the category it belongs to.
+// An episode is checked on its series, found in the series infos fetched by the client:
+// the players list the episodes from them, an episode unknown there is refused.
+func (c *Client) Allowed(account *config.Account, streamType, id string) (bool, error) {
+	if len(account.AllowedGroups) == 0 {
+		return true, nil
+	}
+
+	switch streamType {
+	case "live", "vod":
+		streams, err := c.allowedStreams(account, streamType, "")
+		if err != nil {
+			return false, err
+		}
+		for _, stream := range streams {
+			if strconv.FormatInt(int64(stream.ID), 10) == id {
+				return true, nil
+			}
+		}
+	case "series":
+		series, err := c.allowedSeries(account, "")
+		if err != nil {
+			return false, err
+		}
+		for _, serie := range series {
+			if strconv.FormatInt(int64(serie.SeriesID), 10) == id {
+				return true, nil
+			}
+		}
+	case "episode":
+		if seriesID, ok := c.episodes.lookup(id); ok {
+			return c.Allowed(account, "series", seriesID)
+		}
+	default:
+		return false, fmt.Errorf("unknown stream type %q", streamType)
+	}
+
+	return false, nil
+}
+
+// checkAllowed returns ErrForbidden and its status if the account can't access the stream id of streamType.
+func (c *Client) checkAllowed(account *config.Account, streamType, id string) (int, error) {
+	allowed, err := c.Allowed(account, streamType, id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !allowed {
+		return http.StatusForbidden, ErrForbidden
+	}
+
+	return 0, nil
+}
+
 func validateParams(u url.Values, params ...string) (int, error) {
 	for _, p := range params {
 		if len(u[p]) < 1 {